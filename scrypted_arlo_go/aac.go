@@ -0,0 +1,148 @@
+package scrypted_arlo_go
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// each AAC access unit decodes to this many samples
+const aacSamplesPerFrame = 1024
+
+var aacSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000,
+	24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
+
+// aacConfig is the decoded AudioSpecificConfig of an AAC stream.
+type aacConfig struct {
+	raw        []byte
+	objectType int
+	sampleRate int
+	channels   int
+}
+
+func parseAACConfig(configHex string) (*aacConfig, error) {
+	raw, err := hex.DecodeString(configHex)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode aac config: %w", err)
+	}
+
+	r := &bitReader{data: raw}
+	objectType, err := r.readBits(5)
+	if err != nil {
+		return nil, err
+	}
+	if objectType == 31 {
+		ext, err := r.readBits(6)
+		if err != nil {
+			return nil, err
+		}
+		objectType = 32 + ext
+	}
+
+	freqIndex, err := r.readBits(4)
+	if err != nil {
+		return nil, err
+	}
+	sampleRate := 0
+	if freqIndex == 15 {
+		rate, err := r.readBits(24)
+		if err != nil {
+			return nil, err
+		}
+		sampleRate = int(rate)
+	} else if int(freqIndex) < len(aacSampleRates) {
+		sampleRate = aacSampleRates[freqIndex]
+	} else {
+		return nil, fmt.Errorf("invalid aac frequency index %d", freqIndex)
+	}
+	if sampleRate == 0 {
+		return nil, fmt.Errorf("invalid aac sample rate 0")
+	}
+
+	channels, err := r.readBits(4)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aacConfig{
+		raw:        raw,
+		objectType: int(objectType),
+		sampleRate: sampleRate,
+		channels:   int(channels),
+	}, nil
+}
+
+// aacDepacketizer splits mpeg4-generic RTP payloads (RFC 3640) into
+// AAC access units.
+type aacDepacketizer struct {
+	sizeLength       int
+	indexLength      int
+	indexDeltaLength int
+}
+
+func newAACDepacketizer(track *localStreamTrack) (*aacDepacketizer, error) {
+	d := &aacDepacketizer{}
+	for name, dst := range map[string]*int{
+		"sizelength":       &d.sizeLength,
+		"indexlength":      &d.indexLength,
+		"indexdeltalength": &d.indexDeltaLength,
+	} {
+		v := track.fmtpParam(name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", name, v)
+		}
+		*dst = n
+	}
+	if d.sizeLength == 0 {
+		return nil, fmt.Errorf("aac stream has no sizelength, only AAC-hbr mode is supported")
+	}
+	return d, nil
+}
+
+func (d *aacDepacketizer) depacketize(payload []byte) ([][]byte, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("aac payload too short")
+	}
+
+	headersBits := int(payload[0])<<8 | int(payload[1])
+	headersBytes := (headersBits + 7) / 8
+	if len(payload) < 2+headersBytes {
+		return nil, fmt.Errorf("truncated aac au headers")
+	}
+
+	r := &bitReader{data: payload[2 : 2+headersBytes]}
+	sizes := []int{}
+	for i := 0; r.pos < headersBits; i++ {
+		size, err := r.readBits(d.sizeLength)
+		if err != nil {
+			return nil, err
+		}
+		indexLength := d.indexDeltaLength
+		if i == 0 {
+			indexLength = d.indexLength
+		}
+		if _, err = r.readBits(indexLength); err != nil {
+			return nil, err
+		}
+		sizes = append(sizes, int(size))
+	}
+
+	data := payload[2+headersBytes:]
+	units := [][]byte{}
+	for _, size := range sizes {
+		if size > len(data) {
+			return nil, fmt.Errorf("truncated aac access unit")
+		}
+		unit := make([]byte, size)
+		copy(unit, data[:size])
+		units = append(units, unit)
+		data = data[size:]
+	}
+	return units, nil
+}
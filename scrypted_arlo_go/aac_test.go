@@ -0,0 +1,133 @@
+package scrypted_arlo_go
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAACDepacketizer(t *testing.T) {
+	// AAC-hbr: 13 bit sizes followed by 3 bit indexes
+	track := &localStreamTrack{fmtp: "streamtype=5;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=1210"}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		want    [][]byte
+		wantErr bool
+	}{
+		{
+			name:    "single access unit",
+			payload: []byte{0x00, 0x10, 0x00, 0x18, 0xaa, 0xbb, 0xcc},
+			want:    [][]byte{{0xaa, 0xbb, 0xcc}},
+		},
+		{
+			name:    "two access units",
+			payload: []byte{0x00, 0x20, 0x00, 0x18, 0x00, 0x10, 0xaa, 0xbb, 0xcc, 0xdd, 0xee},
+			want:    [][]byte{{0xaa, 0xbb, 0xcc}, {0xdd, 0xee}},
+		},
+		{
+			name:    "too short",
+			payload: []byte{0x00},
+			wantErr: true,
+		},
+		{
+			name:    "truncated au headers",
+			payload: []byte{0x00, 0x20, 0x00, 0x18},
+			wantErr: true,
+		},
+		{
+			name:    "truncated access unit",
+			payload: []byte{0x00, 0x10, 0x00, 0x18, 0xaa},
+			wantErr: true,
+		},
+	}
+
+	d, err := newAACDepacketizer(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := d.depacketize(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("depacketize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("depacketize() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAACDepacketizer(t *testing.T) {
+	tests := []struct {
+		name    string
+		fmtp    string
+		want    *aacDepacketizer
+		wantErr bool
+	}{
+		{
+			name: "aac-hbr",
+			fmtp: "mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3",
+			want: &aacDepacketizer{sizeLength: 13, indexLength: 3, indexDeltaLength: 3},
+		},
+		{
+			name:    "no sizelength",
+			fmtp:    "mode=AAC-lbr;constantsize=6",
+			wantErr: true,
+		},
+		{
+			name:    "invalid sizelength",
+			fmtp:    "sizelength=thirteen",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newAACDepacketizer(&localStreamTrack{fmtp: tt.fmtp})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newAACDepacketizer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newAACDepacketizer() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAACConfig(t *testing.T) {
+	tests := []struct {
+		config  string
+		want    *aacConfig
+		wantErr bool
+	}{
+		{
+			config: "1210",
+			want:   &aacConfig{raw: []byte{0x12, 0x10}, objectType: 2, sampleRate: 44100, channels: 2},
+		},
+		{
+			config: "1588",
+			want:   &aacConfig{raw: []byte{0x15, 0x88}, objectType: 2, sampleRate: 8000, channels: 1},
+		},
+		{
+			// explicit sample rate of 0
+			config:  "1780000000",
+			wantErr: true,
+		},
+		{config: "17", wantErr: true},
+		{config: "zz", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.config, func(t *testing.T) {
+			got, err := parseAACConfig(tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAACConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAACConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
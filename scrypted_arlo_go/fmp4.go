@@ -0,0 +1,375 @@
+package scrypted_arlo_go
+
+import (
+	"encoding/binary"
+)
+
+// Minimal fragmented MP4 (ISO/IEC 14496-12) muxing, just enough to carry
+// H.264 video and AAC audio in an init segment followed by moof/mdat
+// fragments. This is what both recording and HLS output are built on.
+
+type fmp4TrackKind int
+
+const (
+	fmp4Video fmp4TrackKind = iota
+	fmp4Audio
+)
+
+// fmp4Track describes a track in the init segment.
+type fmp4Track struct {
+	id        uint32
+	kind      fmp4TrackKind
+	timescale uint32
+
+	// video
+	sps    []byte
+	pps    []byte
+	width  int
+	height int
+
+	// audio
+	aac *aacConfig
+}
+
+// fmp4Sample is a single frame within a fragment.
+type fmp4Sample struct {
+	dts      uint64
+	duration uint32
+	data     []byte
+	keyframe bool
+}
+
+type mp4Writer struct {
+	buf []byte
+}
+
+func (w *mp4Writer) u8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *mp4Writer) u16(v uint16) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, v)
+}
+
+func (w *mp4Writer) u24(v uint32) {
+	w.buf = append(w.buf, byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *mp4Writer) u32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *mp4Writer) u64(v uint64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+}
+
+func (w *mp4Writer) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+func (w *mp4Writer) zeros(n int) {
+	w.buf = append(w.buf, make([]byte, n)...)
+}
+
+// box writes a box whose contents are produced by body.
+func (w *mp4Writer) box(typ string, body func()) {
+	start := len(w.buf)
+	w.u32(0)
+	w.bytes([]byte(typ))
+	body()
+	binary.BigEndian.PutUint32(w.buf[start:], uint32(len(w.buf)-start))
+}
+
+func (w *mp4Writer) fullBox(typ string, version uint8, flags uint32, body func()) {
+	w.box(typ, func() {
+		w.u8(version)
+		w.u24(flags)
+		body()
+	})
+}
+
+func (w *mp4Writer) matrix() {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
+
+// fmp4InitSegment builds the ftyp and moov boxes for the given tracks.
+func fmp4InitSegment(tracks []*fmp4Track) []byte {
+	w := &mp4Writer{}
+
+	w.box("ftyp", func() {
+		w.bytes([]byte("iso5"))
+		w.u32(512)
+		w.bytes([]byte("iso5iso6mp41"))
+	})
+
+	w.box("moov", func() {
+		w.fullBox("mvhd", 0, 0, func() {
+			w.u32(0)    // creation_time
+			w.u32(0)    // modification_time
+			w.u32(1000) // timescale
+			w.u32(0)    // duration
+			w.u32(0x00010000)
+			w.u16(0x0100)
+			w.zeros(10)
+			w.matrix()
+			w.zeros(24)
+			w.u32(uint32(len(tracks) + 1)) // next_track_ID
+		})
+
+		for _, t := range tracks {
+			writeTrak(w, t)
+		}
+
+		w.box("mvex", func() {
+			for _, t := range tracks {
+				w.fullBox("trex", 0, 0, func() {
+					w.u32(t.id)
+					w.u32(1) // default_sample_description_index
+					w.u32(0) // default_sample_duration
+					w.u32(0) // default_sample_size
+					w.u32(0) // default_sample_flags
+				})
+			}
+		})
+	})
+
+	return w.buf
+}
+
+func writeTrak(w *mp4Writer, t *fmp4Track) {
+	w.box("trak", func() {
+		w.fullBox("tkhd", 0, 3, func() {
+			w.u32(0) // creation_time
+			w.u32(0) // modification_time
+			w.u32(t.id)
+			w.u32(0) // reserved
+			w.u32(0) // duration
+			w.zeros(8)
+			w.u16(0) // layer
+			w.u16(0) // alternate_group
+			if t.kind == fmp4Audio {
+				w.u16(0x0100)
+			} else {
+				w.u16(0)
+			}
+			w.u16(0)
+			w.matrix()
+			w.u32(uint32(t.width) << 16)
+			w.u32(uint32(t.height) << 16)
+		})
+
+		w.box("mdia", func() {
+			w.fullBox("mdhd", 0, 0, func() {
+				w.u32(0) // creation_time
+				w.u32(0) // modification_time
+				w.u32(t.timescale)
+				w.u32(0)      // duration
+				w.u16(0x55c4) // language "und"
+				w.u16(0)
+			})
+
+			w.fullBox("hdlr", 0, 0, func() {
+				w.u32(0)
+				if t.kind == fmp4Audio {
+					w.bytes([]byte("soun"))
+				} else {
+					w.bytes([]byte("vide"))
+				}
+				w.zeros(12)
+				if t.kind == fmp4Audio {
+					w.bytes([]byte("SoundHandler\x00"))
+				} else {
+					w.bytes([]byte("VideoHandler\x00"))
+				}
+			})
+
+			w.box("minf", func() {
+				if t.kind == fmp4Audio {
+					w.fullBox("smhd", 0, 0, func() {
+						w.u16(0) // balance
+						w.u16(0)
+					})
+				} else {
+					w.fullBox("vmhd", 0, 1, func() {
+						w.zeros(8) // graphicsmode and opcolor
+					})
+				}
+
+				w.box("dinf", func() {
+					w.fullBox("dref", 0, 0, func() {
+						w.u32(1)
+						w.fullBox("url ", 0, 1, func() {})
+					})
+				})
+
+				w.box("stbl", func() {
+					w.fullBox("stsd", 0, 0, func() {
+						w.u32(1)
+						if t.kind == fmp4Audio {
+							writeMP4A(w, t)
+						} else {
+							writeAVC1(w, t)
+						}
+					})
+					w.fullBox("stts", 0, 0, func() { w.u32(0) })
+					w.fullBox("stsc", 0, 0, func() { w.u32(0) })
+					w.fullBox("stsz", 0, 0, func() {
+						w.u32(0)
+						w.u32(0)
+					})
+					w.fullBox("stco", 0, 0, func() { w.u32(0) })
+				})
+			})
+		})
+	})
+}
+
+func writeAVC1(w *mp4Writer, t *fmp4Track) {
+	w.box("avc1", func() {
+		w.zeros(6)
+		w.u16(1) // data_reference_index
+		w.zeros(16)
+		w.u16(uint16(t.width))
+		w.u16(uint16(t.height))
+		w.u32(0x00480000) // horizresolution
+		w.u32(0x00480000) // vertresolution
+		w.u32(0)
+		w.u16(1) // frame_count
+		w.zeros(32)
+		w.u16(0x0018) // depth
+		w.u16(0xffff)
+
+		// left as zero if the sps is too short to carry them
+		var profile [3]byte
+		if len(t.sps) > 1 {
+			copy(profile[:], t.sps[1:])
+		}
+
+		w.box("avcC", func() {
+			w.u8(1)
+			w.u8(profile[0]) // profile
+			w.u8(profile[1]) // profile compatibility
+			w.u8(profile[2]) // level
+			w.u8(0xff)       // 4 byte NAL unit lengths
+			w.u8(0xe1)       // one SPS
+			w.u16(uint16(len(t.sps)))
+			w.bytes(t.sps)
+			w.u8(1) // one PPS
+			w.u16(uint16(len(t.pps)))
+			w.bytes(t.pps)
+		})
+	})
+}
+
+func writeMP4A(w *mp4Writer, t *fmp4Track) {
+	w.box("mp4a", func() {
+		w.zeros(6)
+		w.u16(1) // data_reference_index
+		w.zeros(8)
+		w.u16(uint16(t.aac.channels))
+		w.u16(16) // samplesize
+		w.u16(0)
+		w.u16(0)
+		w.u32(uint32(t.aac.sampleRate) << 16)
+
+		w.fullBox("esds", 0, 0, func() {
+			config := t.aac.raw
+
+			// ES_Descriptor
+			w.u8(0x03)
+			w.u8(uint8(3 + 2 + 13 + 2 + len(config) + 3))
+			w.u16(uint16(t.id))
+			w.u8(0)
+
+			// DecoderConfigDescriptor
+			w.u8(0x04)
+			w.u8(uint8(13 + 2 + len(config)))
+			w.u8(0x40) // MPEG-4 audio
+			w.u8(0x15) // audio stream
+			w.u24(0)   // bufferSizeDB
+			w.u32(0)   // maxBitrate
+			w.u32(0)   // avgBitrate
+
+			// DecoderSpecificInfo
+			w.u8(0x05)
+			w.u8(uint8(len(config)))
+			w.bytes(config)
+
+			// SLConfigDescriptor
+			w.u8(0x06)
+			w.u8(1)
+			w.u8(0x02)
+		})
+	})
+}
+
+const (
+	fmp4SampleFlagsSync    = 0x02000000
+	fmp4SampleFlagsNonSync = 0x01010000
+)
+
+// fmp4Fragment builds a moof and mdat containing the given samples,
+// keyed by track.
+func fmp4Fragment(sequence uint32, tracks []*fmp4Track, samples map[uint32][]fmp4Sample) []byte {
+	// the trun data offsets depend on the size of the moof, which is
+	// the same regardless of the offsets, so build it twice
+	moof := fmp4Moof(sequence, tracks, samples, 0)
+	moof = fmp4Moof(sequence, tracks, samples, uint32(len(moof))+8)
+
+	w := &mp4Writer{buf: moof}
+	w.box("mdat", func() {
+		for _, t := range tracks {
+			for _, s := range samples[t.id] {
+				w.bytes(s.data)
+			}
+		}
+	})
+	return w.buf
+}
+
+func fmp4Moof(sequence uint32, tracks []*fmp4Track, samples map[uint32][]fmp4Sample, dataOffset uint32) []byte {
+	w := &mp4Writer{}
+	w.box("moof", func() {
+		w.fullBox("mfhd", 0, 0, func() {
+			w.u32(sequence)
+		})
+
+		for _, t := range tracks {
+			trackSamples := samples[t.id]
+			if len(trackSamples) == 0 {
+				continue
+			}
+
+			w.box("traf", func() {
+				// default-base-is-moof
+				w.fullBox("tfhd", 0, 0x020000, func() {
+					w.u32(t.id)
+				})
+				w.fullBox("tfdt", 1, 0, func() {
+					w.u64(trackSamples[0].dts)
+				})
+				// data-offset, sample-duration, sample-size and sample-flags present
+				w.fullBox("trun", 0, 0x000701, func() {
+					w.u32(uint32(len(trackSamples)))
+					w.u32(dataOffset)
+					for _, s := range trackSamples {
+						w.u32(s.duration)
+						w.u32(uint32(len(s.data)))
+						if s.keyframe {
+							w.u32(fmp4SampleFlagsSync)
+						} else {
+							w.u32(fmp4SampleFlagsNonSync)
+						}
+					}
+				})
+			})
+
+			for _, s := range trackSamples {
+				dataOffset += uint32(len(s.data))
+			}
+		}
+	})
+	return w.buf
+}
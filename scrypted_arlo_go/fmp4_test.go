@@ -0,0 +1,233 @@
+package scrypted_arlo_go
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+type testMP4Box struct {
+	typ    string
+	offset int // of the box header within the parsed buffer
+	body   []byte
+}
+
+// parseTestMP4Boxes splits data into consecutive boxes, failing the test
+// if the sizes don't add up.
+func parseTestMP4Boxes(t *testing.T, data []byte) []testMP4Box {
+	t.Helper()
+	boxes := []testMP4Box{}
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < 8 {
+			t.Fatalf("truncated box header at %d", offset)
+		}
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		if size < 8 || offset+size > len(data) {
+			t.Fatalf("invalid box size %d at %d", size, offset)
+		}
+		boxes = append(boxes, testMP4Box{
+			typ:    string(data[offset+4 : offset+8]),
+			offset: offset,
+			body:   data[offset+8 : offset+size],
+		})
+		offset += size
+	}
+	return boxes
+}
+
+func testMP4BoxTypes(boxes []testMP4Box) []string {
+	types := []string{}
+	for _, b := range boxes {
+		types = append(types, b.typ)
+	}
+	return types
+}
+
+// findTestMP4Box follows path through nested boxes, skipping the given
+// number of header bytes before the children of each box.
+func findTestMP4Box(t *testing.T, data []byte, path ...string) testMP4Box {
+	t.Helper()
+	// bytes before the child boxes of containers that aren't plain boxes
+	skip := map[string]int{"dref": 8, "stsd": 8, "avc1": 78, "mp4a": 28, "esds": 4}
+
+	var found testMP4Box
+	for _, typ := range path {
+		ok := false
+		for _, b := range parseTestMP4Boxes(t, data) {
+			if b.typ == typ {
+				found, ok = b, true
+				break
+			}
+		}
+		if !ok {
+			t.Fatalf("box %s not found in %v", typ, path)
+		}
+		data = found.body[skip[typ]:]
+	}
+	return found
+}
+
+func TestFMP4InitSegment(t *testing.T) {
+	sps := []byte{0x67, 0x64, 0x00, 0x1f, 0xac}
+	pps := []byte{0x68, 0xee, 0x3c, 0x80}
+	tracks := []*fmp4Track{
+		{
+			id:        fmp4VideoTrackID,
+			kind:      fmp4Video,
+			timescale: 90000,
+			sps:       sps,
+			pps:       pps,
+			width:     1920,
+			height:    1080,
+		},
+		{
+			id:        fmp4AudioTrackID,
+			kind:      fmp4Audio,
+			timescale: 16000,
+			aac:       &aacConfig{raw: []byte{0x14, 0x08}, objectType: 2, sampleRate: 16000, channels: 1},
+		},
+	}
+
+	init := fmp4InitSegment(tracks)
+
+	if got, want := testMP4BoxTypes(parseTestMP4Boxes(t, init)), []string{"ftyp", "moov"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("top level boxes = %v, want %v", got, want)
+	}
+	moov := findTestMP4Box(t, init, "moov")
+	if got, want := testMP4BoxTypes(parseTestMP4Boxes(t, moov.body)), []string{"mvhd", "trak", "trak", "mvex"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("moov boxes = %v, want %v", got, want)
+	}
+
+	for i, trak := range parseTestMP4Boxes(t, moov.body)[1:3] {
+		track := tracks[i]
+
+		tkhd := findTestMP4Box(t, trak.body, "tkhd")
+		if id := binary.BigEndian.Uint32(tkhd.body[12:]); id != track.id {
+			t.Errorf("track %d: tkhd track_ID = %d", track.id, id)
+		}
+		width := binary.BigEndian.Uint32(tkhd.body[len(tkhd.body)-8:]) >> 16
+		height := binary.BigEndian.Uint32(tkhd.body[len(tkhd.body)-4:]) >> 16
+		if int(width) != track.width || int(height) != track.height {
+			t.Errorf("track %d: tkhd dimensions = %dx%d", track.id, width, height)
+		}
+
+		mdhd := findTestMP4Box(t, trak.body, "mdia", "mdhd")
+		if timescale := binary.BigEndian.Uint32(mdhd.body[12:]); timescale != track.timescale {
+			t.Errorf("track %d: mdhd timescale = %d", track.id, timescale)
+		}
+	}
+
+	videoTrak := parseTestMP4Boxes(t, moov.body)[1].body
+	avcC := findTestMP4Box(t, videoTrak, "mdia", "minf", "stbl", "stsd", "avc1", "avcC").body
+	if !bytes.Equal(avcC[1:4], sps[1:4]) {
+		t.Errorf("avcC profile = %x, want %x", avcC[1:4], sps[1:4])
+	}
+	spsLen := int(binary.BigEndian.Uint16(avcC[6:]))
+	if got := avcC[8 : 8+spsLen]; !bytes.Equal(got, sps) {
+		t.Errorf("avcC sps = %x, want %x", got, sps)
+	}
+	rest := avcC[8+spsLen:]
+	ppsLen := int(binary.BigEndian.Uint16(rest[1:]))
+	if got := rest[3 : 3+ppsLen]; !bytes.Equal(got, pps) {
+		t.Errorf("avcC pps = %x, want %x", got, pps)
+	}
+
+	audioTrak := parseTestMP4Boxes(t, moov.body)[2].body
+	esds := findTestMP4Box(t, audioTrak, "mdia", "minf", "stbl", "stsd", "mp4a", "esds").body
+	if !bytes.Contains(esds, []byte{0x05, 0x02, 0x14, 0x08}) {
+		t.Errorf("esds %x doesn't contain the decoder specific info", esds)
+	}
+
+	trex := parseTestMP4Boxes(t, findTestMP4Box(t, moov.body, "mvex").body)
+	if len(trex) != len(tracks) {
+		t.Fatalf("got %d trex boxes, want %d", len(trex), len(tracks))
+	}
+	for i, b := range trex {
+		if id := binary.BigEndian.Uint32(b.body[4:]); id != tracks[i].id {
+			t.Errorf("trex %d track_ID = %d, want %d", i, id, tracks[i].id)
+		}
+	}
+}
+
+func TestFMP4InitSegmentShortSPS(t *testing.T) {
+	// must not panic
+	init := fmp4InitSegment([]*fmp4Track{{id: fmp4VideoTrackID, kind: fmp4Video, timescale: 90000, sps: []byte{0x67}}})
+	parseTestMP4Boxes(t, init)
+}
+
+func TestFMP4Fragment(t *testing.T) {
+	tracks := []*fmp4Track{
+		{id: fmp4VideoTrackID, kind: fmp4Video, timescale: 90000},
+		{id: fmp4AudioTrackID, kind: fmp4Audio, timescale: 16000},
+	}
+	samples := map[uint32][]fmp4Sample{
+		fmp4VideoTrackID: {
+			{dts: 0x100000000, duration: 3000, data: []byte{0, 0, 0, 2, 0x65, 0x01}, keyframe: true},
+			{dts: 0x100000bb8, duration: 3000, data: []byte{0, 0, 0, 1, 0x41}},
+		},
+		fmp4AudioTrackID: {
+			{dts: 2048, duration: aacSamplesPerFrame, data: []byte{0xa1, 0xa2}, keyframe: true},
+		},
+	}
+
+	fragment := fmp4Fragment(7, tracks, samples)
+
+	boxes := parseTestMP4Boxes(t, fragment)
+	if got, want := testMP4BoxTypes(boxes), []string{"moof", "mdat"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("top level boxes = %v, want %v", got, want)
+	}
+	moof := boxes[0]
+
+	mfhd := findTestMP4Box(t, moof.body, "mfhd")
+	if sequence := binary.BigEndian.Uint32(mfhd.body[4:]); sequence != 7 {
+		t.Errorf("mfhd sequence_number = %d, want 7", sequence)
+	}
+
+	trafs := parseTestMP4Boxes(t, moof.body)[1:]
+	if len(trafs) != len(tracks) {
+		t.Fatalf("got %d traf boxes, want %d", len(trafs), len(tracks))
+	}
+	for i, traf := range trafs {
+		track := tracks[i]
+		want := samples[track.id]
+
+		tfhd := findTestMP4Box(t, traf.body, "tfhd")
+		if id := binary.BigEndian.Uint32(tfhd.body[4:]); id != track.id {
+			t.Errorf("traf %d: tfhd track_ID = %d", i, id)
+		}
+		tfdt := findTestMP4Box(t, traf.body, "tfdt")
+		if dts := binary.BigEndian.Uint64(tfdt.body[4:]); dts != want[0].dts {
+			t.Errorf("track %d: tfdt = %x, want %x", track.id, dts, want[0].dts)
+		}
+
+		trun := findTestMP4Box(t, traf.body, "trun").body
+		if count := int(binary.BigEndian.Uint32(trun[4:])); count != len(want) {
+			t.Fatalf("track %d: trun sample_count = %d, want %d", track.id, count, len(want))
+		}
+
+		// data offsets are relative to the start of the moof
+		offset := moof.offset + int(binary.BigEndian.Uint32(trun[8:]))
+		for j, sample := range want {
+			entry := trun[12+12*j:]
+			duration := binary.BigEndian.Uint32(entry)
+			size := int(binary.BigEndian.Uint32(entry[4:]))
+			flags := binary.BigEndian.Uint32(entry[8:])
+
+			if duration != sample.duration {
+				t.Errorf("track %d sample %d: duration = %d, want %d", track.id, j, duration, sample.duration)
+			}
+			if got := fragment[offset : offset+size]; !bytes.Equal(got, sample.data) {
+				t.Errorf("track %d sample %d: data = %x, want %x", track.id, j, got, sample.data)
+			}
+			wantFlags := uint32(fmp4SampleFlagsNonSync)
+			if sample.keyframe {
+				wantFlags = fmp4SampleFlagsSync
+			}
+			if flags != wantFlags {
+				t.Errorf("track %d sample %d: flags = %x, want %x", track.id, j, flags, wantFlags)
+			}
+			offset += size
+		}
+	}
+}
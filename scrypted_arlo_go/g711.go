@@ -0,0 +1,342 @@
+package scrypted_arlo_go
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	g711SampleRate    = 8000
+	g711FrameDuration = 20 * time.Millisecond
+	g711FrameSamples  = 160 // 20ms at 8kHz
+
+	// audio older than this is dropped if PCM is written faster than
+	// real time, to bound the latency
+	g711MaxBufferedSamples = g711SampleRate
+)
+
+// pcmEncoder encodes 16-bit signed little-endian PCM to G.711 and sends
+// it on a local track in 20ms packets.
+type pcmEncoder struct {
+	mgr    *WebRTCManager
+	track  *webrtc.TrackLocalStaticRTP
+	encode func(int16) byte
+	conn   *net.UDPConn
+
+	channels int
+
+	// box filter resampling to 8kHz. each output sample is the average
+	// of the input over a window of step input samples, of which need
+	// remain to be accumulated into acc
+	step float64
+	need float64
+	acc  float64
+
+	lock *sync.Mutex
+
+	// bytes of an incomplete frame left over from the last write
+	partial []byte
+
+	// resampled audio waiting to be sent
+	samples []int16
+
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+// InitializeAudioPCMEncoder adds an audio track that is fed raw 16-bit
+// signed little-endian PCM at sampleRate, with the given number of
+// interleaved channels, and encodes it with codecMimeType, which must be
+// PCMU or PCMA. PCM can be written with WriteAudioPCM or sent in UDP
+// datagrams to the returned port on localhost.
+func (mgr *WebRTCManager) InitializeAudioPCMEncoder(codecMimeType string, sampleRate, channels int) (port int, err error) {
+	mgr.audioPCMLock.Lock()
+	defer mgr.audioPCMLock.Unlock()
+
+	if mgr.audioPCM != nil {
+		return 0, fmt.Errorf("audio pcm encoder already initialized")
+	}
+
+	var encode func(int16) byte
+	switch codecMimeType {
+	case webrtc.MimeTypePCMU:
+		encode = linearToULaw
+	case webrtc.MimeTypePCMA:
+		encode = linearToALaw
+	default:
+		return 0, fmt.Errorf("unsupported codec %s for pcm encoder", codecMimeType)
+	}
+	if sampleRate <= 0 || channels <= 0 {
+		return 0, fmt.Errorf("invalid pcm format: %d Hz with %d channels", sampleRate, channels)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		return 0, err
+	}
+	port, err = strconv.Atoi(strings.Split(conn.LocalAddr().String(), ":")[1])
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+
+	track, err := mgr.addLocalTrack(codecMimeType)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+
+	step := float64(sampleRate) / g711SampleRate
+	e := &pcmEncoder{
+		mgr:       mgr,
+		track:     track,
+		encode:    encode,
+		conn:      conn,
+		channels:  channels,
+		step:      step,
+		need:      step,
+		lock:      &sync.Mutex{},
+		done:      make(chan struct{}),
+		closeOnce: &sync.Once{},
+	}
+	go e.listen()
+	go e.run()
+	mgr.audioPCM = e
+
+	mgr.logger.Info("Created audio PCM encoder for %d Hz, %d channel(s) at udp://127.0.0.1:%d", sampleRate, channels, port)
+	return port, nil
+}
+
+// WriteAudioPCM queues PCM for the encoder set up by
+// InitializeAudioPCMEncoder.
+func (mgr *WebRTCManager) WriteAudioPCM(data []byte) error {
+	e := mgr.getAudioPCM()
+	if e == nil {
+		return fmt.Errorf("audio pcm encoder not initialized")
+	}
+	return e.write(data)
+}
+
+func (mgr *WebRTCManager) getAudioPCM() *pcmEncoder {
+	mgr.audioPCMLock.Lock()
+	defer mgr.audioPCMLock.Unlock()
+	return mgr.audioPCM
+}
+
+// write mixes data down to mono, resamples it to 8kHz and queues it.
+func (e *pcmEncoder) write(data []byte) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	select {
+	case <-e.done:
+		return fmt.Errorf("audio pcm encoder closed")
+	default:
+	}
+
+	frameSize := 2 * e.channels
+	if len(e.partial) > 0 {
+		data = append(e.partial, data...)
+		e.partial = nil
+	}
+	if rem := len(data) % frameSize; rem != 0 {
+		e.partial = append([]byte{}, data[len(data)-rem:]...)
+		data = data[:len(data)-rem]
+	}
+
+	for i := 0; i < len(data); i += frameSize {
+		var sum int
+		for c := 0; c < e.channels; c++ {
+			sum += int(int16(uint16(data[i+2*c]) | uint16(data[i+2*c+1])<<8))
+		}
+		sample := float64(sum) / float64(e.channels)
+
+		for remaining := 1.0; remaining > 0; {
+			take := remaining
+			if take > e.need {
+				take = e.need
+			}
+			e.acc += sample * take
+			e.need -= take
+			remaining -= take
+
+			if e.need <= 0 {
+				e.samples = append(e.samples, int16(e.acc/e.step))
+				e.acc = 0
+				e.need = e.step
+			}
+		}
+	}
+
+	if excess := len(e.samples) - g711MaxBufferedSamples; excess > 0 {
+		e.mgr.logger.Debug("PCM written faster than real time, dropping %d samples", excess)
+		e.samples = append(e.samples[:0], e.samples[excess:]...)
+	}
+	return nil
+}
+
+// nextFrame returns the next 20ms of audio, if enough is queued.
+func (e *pcmEncoder) nextFrame() []int16 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if len(e.samples) < g711FrameSamples {
+		return nil
+	}
+	frame := make([]int16, g711FrameSamples)
+	copy(frame, e.samples)
+	e.samples = append(e.samples[:0], e.samples[g711FrameSamples:]...)
+	return frame
+}
+
+// listen reads PCM sent to the encoder's UDP port.
+func (e *pcmEncoder) listen() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := e.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				e.mgr.logger.Warn("Error during audio pcm read: %s", err)
+			}
+			return
+		}
+		if err := e.write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// run sends a packet every 20ms while audio is queued. Timestamps keep
+// advancing while nothing is queued, so that gaps are played as silence.
+func (e *pcmEncoder) run() {
+	// wait for ice to complete gathering
+	select {
+	case <-e.mgr.iceCompleteSentinel:
+	case <-e.done:
+		return
+	}
+
+	ticker := time.NewTicker(g711FrameDuration)
+	defer ticker.Stop()
+
+	pkt := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			SequenceNumber: uint16(rand.Uint32()),
+			Timestamp:      rand.Uint32(),
+		},
+		Payload: make([]byte, g711FrameSamples),
+	}
+
+	// like packets from the RTP listener, only the first packet is
+	// marked
+	started := false
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		}
+
+		frame := e.nextFrame()
+		if frame == nil {
+			if started {
+				pkt.Timestamp += g711FrameSamples
+			}
+			continue
+		}
+
+		for i, sample := range frame {
+			pkt.Payload[i] = e.encode(sample)
+		}
+		pkt.Marker = !started
+		started = true
+
+		if err := e.track.WriteRTP(&pkt); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				e.mgr.logger.Warn("Error writing to audio track: %s", err)
+			}
+			return
+		}
+		pkt.SequenceNumber++
+		pkt.Timestamp += g711FrameSamples
+	}
+}
+
+func (e *pcmEncoder) close() {
+	e.closeOnce.Do(func() {
+		close(e.done)
+		e.conn.Close()
+	})
+}
+
+// linearToULaw and linearToALaw implement the G.711 encoding tables, see
+// the ITU-T reference implementation.
+var (
+	g711ULawSegmentEnds = [8]int{0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF, 0x1FFF}
+	g711ALawSegmentEnds = [8]int{0x1F, 0x3F, 0x7F, 0xFF, 0x1FF, 0x3FF, 0x7FF, 0xFFF}
+)
+
+func g711Segment(value int, ends *[8]int) int {
+	for i, end := range ends {
+		if value <= end {
+			return i
+		}
+	}
+	return len(ends)
+}
+
+func linearToULaw(sample int16) byte {
+	const (
+		bias = 0x84 >> 2
+		clip = 8159
+	)
+
+	value := int(sample) >> 2
+	mask := 0xFF
+	if value < 0 {
+		value = -value
+		mask = 0x7F
+	}
+	if value > clip {
+		value = clip
+	}
+	value += bias
+
+	segment := g711Segment(value, &g711ULawSegmentEnds)
+	if segment >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	return byte((segment<<4 | (value>>(segment+1))&0xF) ^ mask)
+}
+
+func linearToALaw(sample int16) byte {
+	value := int(sample) >> 3
+	mask := 0xD5
+	if value < 0 {
+		value = -value - 1
+		mask = 0x55
+	}
+
+	segment := g711Segment(value, &g711ALawSegmentEnds)
+	if segment >= 8 {
+		return byte(0x7F ^ mask)
+	}
+	alaw := segment << 4
+	if segment < 2 {
+		alaw |= (value >> 1) & 0xF
+	} else {
+		alaw |= (value >> segment) & 0xF
+	}
+	return byte(alaw ^ mask)
+}
@@ -0,0 +1,152 @@
+package scrypted_arlo_go
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// g711ULawToLinear and g711ALawToLinear are the decoders of the ITU-T
+// reference implementation, used to check the encoders against.
+func g711ULawToLinear(u byte) int {
+	u = ^u
+	t := (int(u&0x0F) << 3) + 0x84
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return 0x84 - t
+	}
+	return t - 0x84
+}
+
+func g711ALawToLinear(a byte) int {
+	a ^= 0x55
+	t := int(a&0x0F) << 4
+	switch segment := int(a&0x70) >> 4; segment {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= segment - 1
+	}
+	if a&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+func TestG711Encode(t *testing.T) {
+	tests := []struct {
+		sample   int16
+		wantULaw byte
+		wantALaw byte
+	}{
+		{sample: 0, wantULaw: 0xFF, wantALaw: 0xD5},
+		{sample: 8, wantULaw: 0xFE, wantALaw: 0xD5},
+		{sample: -8, wantULaw: 0x7E, wantALaw: 0x55},
+		{sample: 1000, wantULaw: 0xCE, wantALaw: 0xFA},
+		{sample: -1000, wantULaw: 0x4E, wantALaw: 0x7A},
+		{sample: 32767, wantULaw: 0x80, wantALaw: 0xAA},
+		{sample: -32768, wantULaw: 0x00, wantALaw: 0x2A},
+	}
+	for _, tt := range tests {
+		if got := linearToULaw(tt.sample); got != tt.wantULaw {
+			t.Errorf("linearToULaw(%d) = %#x, want %#x", tt.sample, got, tt.wantULaw)
+		}
+		if got := linearToALaw(tt.sample); got != tt.wantALaw {
+			t.Errorf("linearToALaw(%d) = %#x, want %#x", tt.sample, got, tt.wantALaw)
+		}
+	}
+}
+
+func TestG711RoundTrip(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		code := byte(i)
+		// negative zero decodes to 0, which encodes as positive zero
+		if code != 0x7F {
+			if got := linearToULaw(int16(g711ULawToLinear(code))); got != code {
+				t.Errorf("linearToULaw(%d) = %#x, want %#x", g711ULawToLinear(code), got, code)
+			}
+		}
+		if got := linearToALaw(int16(g711ALawToLinear(code))); got != code {
+			t.Errorf("linearToALaw(%d) = %#x, want %#x", g711ALawToLinear(code), got, code)
+		}
+	}
+}
+
+func pcmBytes(samples ...int16) []byte {
+	b := []byte{}
+	for _, s := range samples {
+		b = append(b, byte(uint16(s)), byte(uint16(s)>>8))
+	}
+	return b
+}
+
+func TestPCMEncoderResample(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate int
+		channels   int
+		writes     [][]byte
+		want       []int16
+	}{
+		{
+			name:       "8kHz mono",
+			sampleRate: 8000,
+			channels:   1,
+			writes:     [][]byte{pcmBytes(100, -200, 300)},
+			want:       []int16{100, -200, 300},
+		},
+		{
+			name:       "16kHz mono",
+			sampleRate: 16000,
+			channels:   1,
+			writes:     [][]byte{pcmBytes(100, 300, -100, -300)},
+			want:       []int16{200, -200},
+		},
+		{
+			name:       "12kHz mono",
+			sampleRate: 12000,
+			channels:   1,
+			writes:     [][]byte{pcmBytes(300, 300, 600, 600)},
+			want:       []int16{300, 500},
+		},
+		{
+			name:       "8kHz stereo",
+			sampleRate: 8000,
+			channels:   2,
+			writes:     [][]byte{pcmBytes(100, 300, -100, -300)},
+			want:       []int16{200, -200},
+		},
+		{
+			name:       "frame split across writes",
+			sampleRate: 8000,
+			channels:   2,
+			writes:     [][]byte{pcmBytes(100, 300)[:3], pcmBytes(100, 300)[3:]},
+			want:       []int16{200},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step := float64(tt.sampleRate) / g711SampleRate
+			e := &pcmEncoder{
+				channels:  tt.channels,
+				step:      step,
+				need:      step,
+				lock:      &sync.Mutex{},
+				done:      make(chan struct{}),
+				closeOnce: &sync.Once{},
+			}
+			for _, data := range tt.writes {
+				if err := e.write(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(e.samples, tt.want) {
+				t.Errorf("samples = %v, want %v", e.samples, tt.want)
+			}
+		})
+	}
+}
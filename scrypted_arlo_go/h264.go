@@ -0,0 +1,383 @@
+package scrypted_arlo_go
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	h264NALUTypeIDR   = 5
+	h264NALUTypeSEI   = 6
+	h264NALUTypeSPS   = 7
+	h264NALUTypePPS   = 8
+	h264NALUTypeAUD   = 9
+	h264NALUTypeSTAPA = 24
+	h264NALUTypeFUA   = 28
+)
+
+func h264NALUType(nalu []byte) byte {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return nalu[0] & 0x1f
+}
+
+// h264Depacketizer turns RTP payloads (RFC 6184) into NAL units.
+// Only single NAL unit, STAP-A and FU-A packets are supported, which
+// covers everything Arlo cameras are known to send.
+type h264Depacketizer struct {
+	fragments []byte
+	inFU      bool
+}
+
+// depacketize returns the NAL units completed by payload. Fragmented
+// units are buffered until their last fragment arrives.
+func (d *h264Depacketizer) depacketize(payload []byte) ([][]byte, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("empty h264 payload")
+	}
+
+	switch naluType := h264NALUType(payload); {
+	case naluType >= 1 && naluType <= 23:
+		nalu := make([]byte, len(payload))
+		copy(nalu, payload)
+		return [][]byte{nalu}, nil
+
+	case naluType == h264NALUTypeSTAPA:
+		nalus := [][]byte{}
+		for rest := payload[1:]; len(rest) > 0; {
+			if len(rest) < 2 {
+				return nil, fmt.Errorf("truncated STAP-A size")
+			}
+			size := int(rest[0])<<8 | int(rest[1])
+			rest = rest[2:]
+			if size > len(rest) {
+				return nil, fmt.Errorf("truncated STAP-A unit")
+			}
+			nalu := make([]byte, size)
+			copy(nalu, rest[:size])
+			nalus = append(nalus, nalu)
+			rest = rest[size:]
+		}
+		return nalus, nil
+
+	case naluType == h264NALUTypeFUA:
+		if len(payload) < 2 {
+			return nil, fmt.Errorf("truncated FU-A header")
+		}
+		indicator, header := payload[0], payload[1]
+		start, end := header&0x80 != 0, header&0x40 != 0
+
+		if start {
+			d.fragments = append(d.fragments[:0], (indicator&0xe0)|(header&0x1f))
+			d.inFU = true
+		} else if !d.inFU {
+			// we missed the start of this unit
+			return nil, nil
+		}
+		d.fragments = append(d.fragments, payload[2:]...)
+
+		if !end {
+			return nil, nil
+		}
+		d.inFU = false
+		nalu := make([]byte, len(d.fragments))
+		copy(nalu, d.fragments)
+		return [][]byte{nalu}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported h264 packetization type %d", h264NALUType(payload))
+}
+
+// reset drops any partially received unit, e.g. after packet loss.
+func (d *h264Depacketizer) reset() {
+	d.inFU = false
+	d.fragments = d.fragments[:0]
+}
+
+// h264ParameterSetsFromFmtp decodes sprop-parameter-sets into SPS and PPS.
+func h264ParameterSetsFromFmtp(spropParameterSets string) (sps, pps []byte) {
+	for _, encoded := range strings.Split(spropParameterSets, ",") {
+		nalu, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			continue
+		}
+		switch h264NALUType(nalu) {
+		case h264NALUTypeSPS:
+			sps = nalu
+		case h264NALUTypePPS:
+			pps = nalu
+		}
+	}
+	return sps, pps
+}
+
+// h264AnnexB joins NAL units with start codes.
+func h264AnnexB(nalus ...[]byte) []byte {
+	out := []byte{}
+	for _, nalu := range nalus {
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// bitReader reads big-endian bit fields and exp-Golomb codes.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) readBit() (uint32, error) {
+	if r.pos >= len(r.data)*8 {
+		return 0, fmt.Errorf("read past end of data")
+	}
+	bit := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+	r.pos++
+	return uint32(bit), nil
+}
+
+func (r *bitReader) readBits(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | bit
+	}
+	return v, nil
+}
+
+func (r *bitReader) readUE() (uint32, error) {
+	zeros := 0
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, fmt.Errorf("invalid exp-golomb code")
+		}
+	}
+	v, err := r.readBits(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1 << zeros) - 1 + v, nil
+}
+
+func (r *bitReader) readSE() (int32, error) {
+	v, err := r.readUE()
+	if err != nil {
+		return 0, err
+	}
+	if v&1 == 1 {
+		return int32((v + 1) / 2), nil
+	}
+	return -int32(v / 2), nil
+}
+
+// removeEmulationPrevention strips the 0x03 bytes inserted after
+// every 0x0000 sequence in a NAL unit.
+func removeEmulationPrevention(nalu []byte) []byte {
+	out := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// h264SPSDimensions parses the picture size out of an SPS.
+func h264SPSDimensions(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, fmt.Errorf("sps too short")
+	}
+	r := &bitReader{data: removeEmulationPrevention(sps[1:])}
+
+	profileIDC, err := r.readBits(8)
+	if err != nil {
+		return 0, 0, err
+	}
+	// constraint flags and level
+	if _, err = r.readBits(16); err != nil {
+		return 0, 0, err
+	}
+	// seq_parameter_set_id
+	if _, err = r.readUE(); err != nil {
+		return 0, 0, err
+	}
+
+	chromaFormatIDC := uint32(1)
+	switch profileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormatIDC, err = r.readUE(); err != nil {
+			return 0, 0, err
+		}
+		if chromaFormatIDC == 3 {
+			// separate_colour_plane_flag
+			if _, err = r.readBit(); err != nil {
+				return 0, 0, err
+			}
+		}
+		// bit_depth_luma_minus8, bit_depth_chroma_minus8
+		if _, err = r.readUE(); err != nil {
+			return 0, 0, err
+		}
+		if _, err = r.readUE(); err != nil {
+			return 0, 0, err
+		}
+		// qpprime_y_zero_transform_bypass_flag
+		if _, err = r.readBit(); err != nil {
+			return 0, 0, err
+		}
+		scalingMatrixPresent, err := r.readBit()
+		if err != nil {
+			return 0, 0, err
+		}
+		if scalingMatrixPresent == 1 {
+			lists := 8
+			if chromaFormatIDC == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.readBit()
+				if err != nil {
+					return 0, 0, err
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						delta, err := r.readSE()
+						if err != nil {
+							return 0, 0, err
+						}
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	// log2_max_frame_num_minus4
+	if _, err = r.readUE(); err != nil {
+		return 0, 0, err
+	}
+	pocType, err := r.readUE()
+	if err != nil {
+		return 0, 0, err
+	}
+	switch pocType {
+	case 0:
+		// log2_max_pic_order_cnt_lsb_minus4
+		if _, err = r.readUE(); err != nil {
+			return 0, 0, err
+		}
+	case 1:
+		// delta_pic_order_always_zero_flag
+		if _, err = r.readBit(); err != nil {
+			return 0, 0, err
+		}
+		// offset_for_non_ref_pic, offset_for_top_to_bottom_field
+		if _, err = r.readSE(); err != nil {
+			return 0, 0, err
+		}
+		if _, err = r.readSE(); err != nil {
+			return 0, 0, err
+		}
+		cycle, err := r.readUE()
+		if err != nil {
+			return 0, 0, err
+		}
+		for i := uint32(0); i < cycle; i++ {
+			if _, err = r.readSE(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	// max_num_ref_frames
+	if _, err = r.readUE(); err != nil {
+		return 0, 0, err
+	}
+	// gaps_in_frame_num_value_allowed_flag
+	if _, err = r.readBit(); err != nil {
+		return 0, 0, err
+	}
+
+	widthInMBs, err := r.readUE()
+	if err != nil {
+		return 0, 0, err
+	}
+	heightInMapUnits, err := r.readUE()
+	if err != nil {
+		return 0, 0, err
+	}
+	frameMBsOnly, err := r.readBit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if frameMBsOnly == 0 {
+		// mb_adaptive_frame_field_flag
+		if _, err = r.readBit(); err != nil {
+			return 0, 0, err
+		}
+	}
+	// direct_8x8_inference_flag
+	if _, err = r.readBit(); err != nil {
+		return 0, 0, err
+	}
+
+	width = int(widthInMBs+1) * 16
+	height = int(2-frameMBsOnly) * int(heightInMapUnits+1) * 16
+
+	cropping, err := r.readBit()
+	if err != nil {
+		return 0, 0, err
+	}
+	if cropping == 1 {
+		crop := make([]uint32, 4)
+		for i := range crop {
+			if crop[i], err = r.readUE(); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		cropUnitX, cropUnitY := 1, 2-int(frameMBsOnly)
+		switch chromaFormatIDC {
+		case 1:
+			cropUnitX, cropUnitY = 2, 2*(2-int(frameMBsOnly))
+		case 2:
+			cropUnitX, cropUnitY = 2, 2-int(frameMBsOnly)
+		}
+		width -= cropUnitX * int(crop[0]+crop[1])
+		height -= cropUnitY * int(crop[2]+crop[3])
+	}
+
+	return width, height, nil
+}
@@ -0,0 +1,117 @@
+package scrypted_arlo_go
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestH264Depacketizer(t *testing.T) {
+	tests := []struct {
+		name     string
+		payloads [][]byte
+		want     [][]byte
+		wantErr  bool
+	}{
+		{
+			name:     "single nal unit",
+			payloads: [][]byte{{0x65, 0x01, 0x02}},
+			want:     [][]byte{{0x65, 0x01, 0x02}},
+		},
+		{
+			name: "stap-a",
+			payloads: [][]byte{{
+				0x78,
+				0x00, 0x02, 0x67, 0x42,
+				0x00, 0x03, 0x68, 0xce, 0x38,
+			}},
+			want: [][]byte{{0x67, 0x42}, {0x68, 0xce, 0x38}},
+		},
+		{
+			name: "fu-a",
+			payloads: [][]byte{
+				{0x7c, 0x85, 0x01, 0x02},
+				{0x7c, 0x05, 0x03},
+				{0x7c, 0x45, 0x04},
+			},
+			want: [][]byte{{0x65, 0x01, 0x02, 0x03, 0x04}},
+		},
+		{
+			name: "fu-a after another fu-a",
+			payloads: [][]byte{
+				{0x7c, 0x85, 0x01},
+				{0x7c, 0x45, 0x02},
+				{0x5c, 0x81, 0x03},
+				{0x5c, 0x41, 0x04},
+			},
+			want: [][]byte{{0x65, 0x01, 0x02}, {0x41, 0x03, 0x04}},
+		},
+		{
+			name: "fu-a without start",
+			payloads: [][]byte{
+				{0x7c, 0x05, 0x03},
+				{0x7c, 0x45, 0x04},
+			},
+		},
+		{
+			name:     "empty payload",
+			payloads: [][]byte{{}},
+			wantErr:  true,
+		},
+		{
+			name:     "truncated stap-a size",
+			payloads: [][]byte{{0x78, 0x00}},
+			wantErr:  true,
+		},
+		{
+			name:     "truncated stap-a unit",
+			payloads: [][]byte{{0x78, 0x00, 0x05, 0x67}},
+			wantErr:  true,
+		},
+		{
+			name:     "truncated fu-a header",
+			payloads: [][]byte{{0x7c}},
+			wantErr:  true,
+		},
+		{
+			name:     "stap-b",
+			payloads: [][]byte{{0x79, 0x00, 0x00}},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &h264Depacketizer{}
+			var got [][]byte
+			var err error
+			for _, payload := range tt.payloads {
+				var nalus [][]byte
+				nalus, err = d.depacketize(payload)
+				got = append(got, nalus...)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("depacketize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("depacketize() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestH264DepacketizerReset(t *testing.T) {
+	d := &h264Depacketizer{}
+	if _, err := d.depacketize([]byte{0x7c, 0x85, 0x01}); err != nil {
+		t.Fatal(err)
+	}
+	d.reset()
+
+	// the end of the interrupted unit must not be emitted
+	nalus, err := d.depacketize([]byte{0x7c, 0x45, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nalus) != 0 {
+		t.Errorf("depacketize() after reset = %x, want nothing", nalus)
+	}
+}
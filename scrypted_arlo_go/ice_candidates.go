@@ -0,0 +1,96 @@
+package scrypted_arlo_go
+
+import (
+	"sync"
+)
+
+// iceCandidateLog keeps every allowed local candidate in the order it was
+// gathered, so that any number of readers each see all of them instead of
+// taking them from one another.
+type iceCandidateLog struct {
+	lock       *sync.Mutex
+	candidates []WebRTCICECandidate
+	complete   bool
+
+	// closed and replaced whenever a candidate is added or gathering
+	// completes
+	updated chan struct{}
+}
+
+func newICECandidateLog() *iceCandidateLog {
+	return &iceCandidateLog{
+		lock:    &sync.Mutex{},
+		updated: make(chan struct{}),
+	}
+}
+
+func (l *iceCandidateLog) add(c WebRTCICECandidate) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.candidates = append(l.candidates, c)
+	l.notify()
+}
+
+// finish marks gathering as complete, or abandoned if the connection is
+// closed first.
+func (l *iceCandidateLog) finish() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.complete {
+		l.complete = true
+		l.notify()
+	}
+}
+
+// notify wakes up waiting readers, the lock must be held.
+func (l *iceCandidateLog) notify() {
+	close(l.updated)
+	l.updated = make(chan struct{})
+}
+
+// next blocks until the i-th candidate is gathered and returns it. It
+// returns false if gathering completes without one, or done is closed.
+func (l *iceCandidateLog) next(i int, done <-chan struct{}) (WebRTCICECandidate, bool) {
+	for {
+		l.lock.Lock()
+		if i < len(l.candidates) {
+			c := l.candidates[i]
+			l.lock.Unlock()
+			return c, true
+		}
+		if l.complete {
+			l.lock.Unlock()
+			return WebRTCICECandidate{}, false
+		}
+		updated := l.updated
+		l.lock.Unlock()
+
+		select {
+		case <-updated:
+		case <-done:
+			return WebRTCICECandidate{}, false
+		}
+	}
+}
+
+// subscribe returns a channel that receives every candidate, starting with
+// those already gathered, and is closed once gathering completes. It stops
+// being fed once done is closed.
+func (l *iceCandidateLog) subscribe(done <-chan struct{}) <-chan WebRTCICECandidate {
+	candidates := make(chan WebRTCICECandidate)
+	go func() {
+		defer close(candidates)
+		for i := 0; ; i++ {
+			c, ok := l.next(i, done)
+			if !ok {
+				return
+			}
+			select {
+			case candidates <- c:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return candidates
+}
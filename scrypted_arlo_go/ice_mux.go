@@ -0,0 +1,91 @@
+package scrypted_arlo_go
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v3"
+)
+
+// ICEMux carries the ICE traffic of every manager it is passed to, via
+// WebRTCOptions.ICEMux, over a single UDP port and optionally a single
+// TCP port. It should be created once per process and closed only after
+// the managers using it.
+type ICEMux struct {
+	udpMux      *ice.MultiUDPMuxDefault
+	tcpMux      *ice.TCPMuxDefault
+	tcpListener net.Listener
+
+	closeOnce *sync.Once
+}
+
+// NewICEMux listens for ICE on udpPort, and on tcpPort for ICE-TCP unless
+// it is 0. The interfaces and addresses listened on follow the interface
+// and address rules of candidatePolicy, or all of them if it is nil. The
+// muxes log to logger at debug level, or to stdout if it is nil.
+func NewICEMux(udpPort, tcpPort int, candidatePolicy *ICECandidatePolicy, logger *Logger) (*ICEMux, error) {
+	candidatePolicy, err := candidatePolicy.compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid ICE candidate policy: %w", err)
+	}
+
+	if logger == nil {
+		logger = newStdoutLogger("ICEMux")
+	}
+	loggerFactory := logging.NewDefaultLoggerFactory()
+	loggerFactory.Writer = debugWriter{logger}
+
+	mux := &ICEMux{closeOnce: &sync.Once{}}
+	mux.udpMux, err = ice.NewMultiUDPMuxFromPort(udpPort,
+		ice.UDPMuxFromPortWithInterfaceFilter(candidatePolicy.allowsInterface),
+		ice.UDPMuxFromPortWithIPFilter(candidatePolicy.allowsLocalIP),
+		ice.UDPMuxFromPortWithLogger(loggerFactory.NewLogger("udpmux")),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on UDP port %d: %w", udpPort, err)
+	}
+
+	if tcpPort != 0 {
+		mux.tcpListener, err = net.ListenTCP("tcp", &net.TCPAddr{Port: tcpPort})
+		if err != nil {
+			mux.udpMux.Close()
+			return nil, fmt.Errorf("could not listen on TCP port %d: %w", tcpPort, err)
+		}
+		mux.tcpMux = ice.NewTCPMuxDefault(ice.TCPMuxParams{
+			Listener:       mux.tcpListener,
+			Logger:         loggerFactory.NewLogger("tcpmux"),
+			ReadBufferSize: 8,
+		})
+	}
+
+	return mux, nil
+}
+
+// applyTo routes the ICE traffic of the setting engine's peer connections
+// through the mux.
+func (mux *ICEMux) applyTo(s *webrtc.SettingEngine) {
+	s.SetICEUDPMux(mux.udpMux)
+	if mux.tcpMux != nil {
+		s.SetICETCPMux(mux.tcpMux)
+		s.SetNetworkTypes([]webrtc.NetworkType{
+			webrtc.NetworkTypeUDP4,
+			webrtc.NetworkTypeUDP6,
+			webrtc.NetworkTypeTCP4,
+			webrtc.NetworkTypeTCP6,
+		})
+	}
+}
+
+// Close stops listening. Sessions still using the mux lose connectivity.
+func (mux *ICEMux) Close() {
+	mux.closeOnce.Do(func() {
+		mux.udpMux.Close()
+		if mux.tcpMux != nil {
+			mux.tcpMux.Close()
+			mux.tcpListener.Close()
+		}
+	})
+}
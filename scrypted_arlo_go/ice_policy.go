@@ -0,0 +1,199 @@
+package scrypted_arlo_go
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/exp/slices"
+)
+
+// network types for ICECandidatePolicy
+const (
+	ICENetworkTypeIPv4 = "ipv4"
+	ICENetworkTypeIPv6 = "ipv6"
+)
+
+// candidate types for ICECandidatePolicy
+const (
+	ICECandidateTypeHost  = "host"
+	ICECandidateTypeSrflx = "srflx"
+	ICECandidateTypePrflx = "prflx"
+	ICECandidateTypeRelay = "relay"
+)
+
+// ICECandidatePolicy decides which local ICE candidates are gathered and
+// sent to the remote. An empty allow list allows everything, and deny
+// rules take precedence over allow rules, so the zero value allows every
+// candidate.
+//
+// Interface rules are applied when gathering, since a candidate doesn't
+// record the interface it came from. Interface names may be patterns,
+// e.g. "br-*" or "veth*" for Docker bridges. CIDR rules apply to the local
+// addresses candidates are gathered on, and so to host candidates. Server
+// reflexive and relay candidates carry a public address instead, which
+// CIDR rules don't apply to; use the candidate type rules for those.
+type ICECandidatePolicy struct {
+	AllowNetworkTypes []string
+	DenyNetworkTypes  []string
+
+	AllowCandidateTypes []string
+	DenyCandidateTypes  []string
+
+	AllowInterfaces []string
+	DenyInterfaces  []string
+
+	AllowCIDRs []string
+	DenyCIDRs  []string
+
+	// drop host candidates that hide their address behind an mDNS name
+	DenyMDNS bool
+
+	// parsed from AllowCIDRs and DenyCIDRs
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+}
+
+// NewICECandidatePolicy returns a policy that allows every candidate, which
+// is what a nil policy means.
+func NewICECandidatePolicy() *ICECandidatePolicy {
+	return &ICECandidatePolicy{}
+}
+
+// DefaultICECandidatePolicy returns the policy SIPWebRTCManager uses when
+// none is given. It denies IPv6 and mDNS candidates, since Arlo's servers
+// are only known to handle IPv4 addresses.
+func DefaultICECandidatePolicy() *ICECandidatePolicy {
+	return &ICECandidatePolicy{
+		DenyNetworkTypes: []string{ICENetworkTypeIPv6},
+		DenyMDNS:         true,
+	}
+}
+
+// compile validates the policy and returns a copy ready for matching.
+func (p *ICECandidatePolicy) compile() (*ICECandidatePolicy, error) {
+	if p == nil {
+		p = NewICECandidatePolicy()
+	}
+	compiled := *p
+
+	for _, t := range append(slices.Clone(p.AllowNetworkTypes), p.DenyNetworkTypes...) {
+		if t != ICENetworkTypeIPv4 && t != ICENetworkTypeIPv6 {
+			return nil, fmt.Errorf("unknown ICE network type %q", t)
+		}
+	}
+	for _, t := range append(slices.Clone(p.AllowCandidateTypes), p.DenyCandidateTypes...) {
+		if _, err := webrtc.NewICECandidateType(t); err != nil {
+			return nil, fmt.Errorf("unknown ICE candidate type %q", t)
+		}
+	}
+	for _, pattern := range append(slices.Clone(p.AllowInterfaces), p.DenyInterfaces...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid interface pattern %q: %w", pattern, err)
+		}
+	}
+
+	parseCIDRs := func(cidrs []string) ([]*net.IPNet, error) {
+		nets := []*net.IPNet{}
+		for _, cidr := range cidrs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse CIDR: %w", err)
+			}
+			nets = append(nets, ipNet)
+		}
+		return nets, nil
+	}
+	var err error
+	if compiled.allowNets, err = parseCIDRs(p.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if compiled.denyNets, err = parseCIDRs(p.DenyCIDRs); err != nil {
+		return nil, err
+	}
+
+	return &compiled, nil
+}
+
+// applyTo restricts gathering to the interfaces and addresses that the
+// policy allows.
+func (p *ICECandidatePolicy) applyTo(s *webrtc.SettingEngine) {
+	if len(p.AllowInterfaces) > 0 || len(p.DenyInterfaces) > 0 {
+		s.SetInterfaceFilter(p.allowsInterface)
+	}
+	s.SetIPFilter(p.allowsLocalIP)
+}
+
+func (p *ICECandidatePolicy) allowsInterface(name string) bool {
+	matches := func(patterns []string) bool {
+		return slices.ContainsFunc(patterns, func(pattern string) bool {
+			matched, _ := path.Match(pattern, name)
+			return matched
+		})
+	}
+	if matches(p.DenyInterfaces) {
+		return false
+	}
+	return len(p.AllowInterfaces) == 0 || matches(p.AllowInterfaces)
+}
+
+func (p *ICECandidatePolicy) allowsNetworkType(ip net.IP) bool {
+	networkType := ICENetworkTypeIPv6
+	if ip.To4() != nil {
+		networkType = ICENetworkTypeIPv4
+	}
+	return allowedBy(networkType, p.AllowNetworkTypes, p.DenyNetworkTypes)
+}
+
+// allowsLocalIP reports whether candidates may be gathered on a local
+// address, applying the CIDR rules.
+func (p *ICECandidatePolicy) allowsLocalIP(ip net.IP) bool {
+	if !p.allowsNetworkType(ip) {
+		return false
+	}
+
+	contains := func(nets []*net.IPNet) bool {
+		return slices.ContainsFunc(nets, func(n *net.IPNet) bool { return n.Contains(ip) })
+	}
+	if contains(p.denyNets) {
+		return false
+	}
+	return len(p.allowNets) == 0 || contains(p.allowNets)
+}
+
+// allowsCandidate reports whether a gathered candidate may be sent to the
+// remote.
+func (p *ICECandidatePolicy) allowsCandidate(candidateType, address string) bool {
+	if !allowedBy(candidateType, p.AllowCandidateTypes, p.DenyCandidateTypes) {
+		return false
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		// not an IP, so the address is an mDNS name
+		return !p.DenyMDNS
+	}
+	if candidateType == ICECandidateTypeHost {
+		return p.allowsLocalIP(ip)
+	}
+	return p.allowsNetworkType(ip)
+}
+
+// allowsSDPCandidate is allowsCandidate for the value of an SDP
+// candidate attribute, with or without the "candidate:" prefix.
+func (p *ICECandidatePolicy) allowsSDPCandidate(candidate string) bool {
+	// foundation component transport priority address port typ type ...
+	fields := strings.Fields(strings.TrimPrefix(candidate, "candidate:"))
+	if len(fields) < 8 || fields[6] != "typ" {
+		return false
+	}
+	return p.allowsCandidate(fields[7], fields[4])
+}
+
+func allowedBy(value string, allow, deny []string) bool {
+	if slices.Contains(deny, value) {
+		return false
+	}
+	return len(allow) == 0 || slices.Contains(allow, value)
+}
@@ -0,0 +1,77 @@
+package scrypted_arlo_go
+
+import (
+	"testing"
+)
+
+func TestICECandidatePolicyAllowsCandidate(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        *ICECandidatePolicy
+		candidateType string
+		address       string
+		want          bool
+	}{
+		{
+			name:          "zero value allows mDNS",
+			policy:        &ICECandidatePolicy{},
+			candidateType: ICECandidateTypeHost,
+			address:       "0c3b7d6e-1b0f-4c8e-9d8e-3f4c1a2b5d6e.local",
+			want:          true,
+		},
+		{
+			name:          "default denies mDNS",
+			policy:        DefaultICECandidatePolicy(),
+			candidateType: ICECandidateTypeHost,
+			address:       "0c3b7d6e-1b0f-4c8e-9d8e-3f4c1a2b5d6e.local",
+			want:          false,
+		},
+		{
+			name:          "default denies IPv6",
+			policy:        DefaultICECandidatePolicy(),
+			candidateType: ICECandidateTypeSrflx,
+			address:       "2001:db8::1",
+			want:          false,
+		},
+		{
+			name:          "host inside allowed CIDR",
+			policy:        &ICECandidatePolicy{AllowCIDRs: []string{"192.168.1.0/24"}},
+			candidateType: ICECandidateTypeHost,
+			address:       "192.168.1.20",
+			want:          true,
+		},
+		{
+			name:          "host outside allowed CIDR",
+			policy:        &ICECandidatePolicy{AllowCIDRs: []string{"192.168.1.0/24"}},
+			candidateType: ICECandidateTypeHost,
+			address:       "172.17.0.1",
+			want:          false,
+		},
+		{
+			name:          "srflx ignores CIDRs",
+			policy:        &ICECandidatePolicy{AllowCIDRs: []string{"192.168.1.0/24"}},
+			candidateType: ICECandidateTypeSrflx,
+			address:       "203.0.113.7",
+			want:          true,
+		},
+		{
+			name:          "relay denied by type",
+			policy:        &ICECandidatePolicy{DenyCandidateTypes: []string{ICECandidateTypeRelay}},
+			candidateType: ICECandidateTypeRelay,
+			address:       "203.0.113.7",
+			want:          false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.policy.compile()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.allowsCandidate(tt.candidateType, tt.address); got != tt.want {
+				t.Errorf("allowsCandidate(%s, %s) = %v, want %v", tt.candidateType, tt.address, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,30 +3,57 @@ package scrypted_arlo_go
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/beatgammit/rtsp"
 )
 
 type LocalStreamProxy struct {
-	infoLogger   *TCPLogger
-	debugLogger  *TCPLogger
-	extraVerbose bool
+	logger *Logger
 
 	basestationHostname string
 	basestationIP       string
 	certPEM             string
 	keyPEM              string
 
-	tlsConfig    *tls.Config
+	// tlsConfig can no longer be changed once tlsConfigUsed is set by the
+	// first connection to the basestation
+	tlsConfig     *tls.Config
+	tlsConfigUsed bool
+	tlsLock       *sync.Mutex
+
 	listener     net.Listener
 	listenerPort int
-	backend      net.Conn
+
+	// every connected client gets its own session to the basestation
+	sessions      map[*localStreamSession]struct{}
+	sessionsLock  *sync.Mutex
+	nextSessionID int
+
+	// media demuxed from the proxied streams is handed to sinks. only one
+	// session at a time publishes to the sinks, so that multiple clients
+	// don't result in duplicated media
+	sinks           map[string]localStreamSink
+	publisher       *localStreamSession
+	publisherTracks []*localStreamTrack
+	sdp             string
+	mediaLock       *sync.Mutex
+
+	// optional HLS output, pulling its own stream from the basestation
+	hls *localHLSOutput
 }
 
+// NewLocalStreamProxy creates a proxy to the basestation at basestationIP,
+// authenticating with certPEM and keyPEM. The proxy refuses to connect to
+// the basestation until SetBasestationVerification is called; prefer
+// NewLocalStreamProxyWithVerification.
 func NewLocalStreamProxy(
 	infoLoggerPort, debugLoggerPort int,
 	basestationHostname string,
@@ -34,55 +61,126 @@ func NewLocalStreamProxy(
 	certPEM string,
 	keyPEM string,
 ) (*LocalStreamProxy, error) {
-	name := "LocalStreamProxy"
-	infoLogger, err := NewTCPLogger(infoLoggerPort, name)
-	if err != nil {
-		return nil, err
-	}
-	debugLogger, err := NewTCPLogger(debugLoggerPort, name)
+	logger, err := NewLogger(infoLoggerPort, debugLoggerPort, "LocalStreamProxy")
 	if err != nil {
 		return nil, err
 	}
 
 	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
 	if err != nil {
+		logger.Close()
 		return nil, fmt.Errorf("could not load TLS certificate and key: %w", err)
 	}
 
 	return &LocalStreamProxy{
-		infoLogger:          infoLogger,
-		debugLogger:         debugLogger,
+		logger:              logger,
 		basestationHostname: basestationHostname,
 		basestationIP:       basestationIP,
 		certPEM:             certPEM,
 		keyPEM:              keyPEM,
+		// we connect by IP, so the default verification can't be used and
+		// the hostname is checked by our own verifier instead
 		tlsConfig: &tls.Config{
 			Certificates:       []tls.Certificate{cert},
 			InsecureSkipVerify: true,
 		},
+		tlsLock:      &sync.Mutex{},
+		sessions:     map[*localStreamSession]struct{}{},
+		sessionsLock: &sync.Mutex{},
+		sinks:        map[string]localStreamSink{},
+		mediaLock:    &sync.Mutex{},
 	}, nil
 }
 
-func (l *LocalStreamProxy) MakeExtraVerbose() {
-	l.extraVerbose = true
+// NewLocalStreamProxyWithVerification is NewLocalStreamProxy, verifying
+// the basestation as described in SetBasestationVerification.
+func NewLocalStreamProxyWithVerification(
+	infoLoggerPort, debugLoggerPort int,
+	basestationHostname string,
+	basestationIP string,
+	certPEM string,
+	keyPEM string,
+	basestationCertPEM string,
+	caPEM string,
+) (*LocalStreamProxy, error) {
+	l, err := NewLocalStreamProxy(infoLoggerPort, debugLoggerPort, basestationHostname, basestationIP, certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.SetBasestationVerification(basestationCertPEM, caPEM); err != nil {
+		l.logger.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// SetBasestationVerification checks the basestation's certificate against
+// basestationCertPEM if set, which pins that exact certificate, and
+// against caPEM and the basestation hostname if set. It must be called
+// before anything connects to the basestation, i.e. before Start, StartHLS,
+// StartRecording or GrabKeyframe.
+func (l *LocalStreamProxy) SetBasestationVerification(basestationCertPEM, caPEM string) error {
+	l.tlsLock.Lock()
+	defer l.tlsLock.Unlock()
+
+	if l.tlsConfigUsed {
+		return fmt.Errorf("basestation verification must be set before connecting to the basestation")
+	}
+	if basestationCertPEM == "" && caPEM == "" {
+		return fmt.Errorf("no basestation certificate or CA provided")
+	}
+
+	verifier, err := newPeerCertificateVerifier(l.basestationHostname, basestationCertPEM, caPEM)
+	if err != nil {
+		return fmt.Errorf("could not set up basestation verification: %w", err)
+	}
+	l.tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if err := verifier(rawCerts, verifiedChains); err != nil {
+			return fmt.Errorf("refusing connection to basestation %s (%s): %w", l.basestationHostname, l.basestationIP, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// basestationTLSConfig returns the config to connect to the basestation
+// with, after which it can't be changed, or an error if the basestation
+// can't be verified.
+func (l *LocalStreamProxy) basestationTLSConfig() (*tls.Config, error) {
+	l.tlsLock.Lock()
+	defer l.tlsLock.Unlock()
+
+	if l.tlsConfig.VerifyPeerCertificate == nil {
+		return nil, fmt.Errorf("refusing to connect to basestation %s (%s): no basestation certificate or CA provided", l.basestationHostname, l.basestationIP)
+	}
+	l.tlsConfigUsed = true
+	return l.tlsConfig, nil
 }
 
-func (l *LocalStreamProxy) Info(msg string, args ...any) {
-	l.infoLogger.Send(fmt.Sprintf(msg+"\n", args...))
+// MakeExtraVerbose enables trace logging, which includes every message
+// passing through the proxy.
+func (l *LocalStreamProxy) MakeExtraVerbose() {
+	l.logger.SetLevel("trace")
 }
 
-func (l *LocalStreamProxy) Debug(msg string, args ...any) {
-	l.debugLogger.Send(fmt.Sprintf(msg+"\n", args...))
+// GetLogger returns the proxy's logger, e.g. to set the device ID field,
+// the level or the output format.
+func (l *LocalStreamProxy) GetLogger() *Logger {
+	return l.logger
 }
 
 func (l *LocalStreamProxy) Start() (port int, err error) {
+	if _, err := l.basestationTLSConfig(); err != nil {
+		return 0, err
+	}
+
 	// Create TCP listener
 	l.listener, err = net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		return 0, fmt.Errorf("error creating TCP listener: %w", err)
 	}
 
-	l.Info("TCP proxy server listening on %s", l.listener.Addr())
+	l.logger.Info("TCP proxy server listening on %s", l.listener.Addr())
 
 	port, err = strconv.Atoi(strings.Split(l.listener.Addr().String(), ":")[1])
 	if err != nil {
@@ -92,151 +190,389 @@ func (l *LocalStreamProxy) Start() (port int, err error) {
 
 	l.listenerPort = port
 
-	// Accept incoming connections and handle them in a new goroutine
+	// Accept incoming connections and handle each in a new goroutine
 	go func() {
 		defer l.listener.Close()
 
-		clientConn, err := l.listener.Accept()
+		for {
+			clientConn, err := l.listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					l.logger.Warn("Error accepting connection: %s", err)
+				}
+				return
+			}
+
+			session := l.newSession(clientConn)
+			go func() {
+				defer l.removeSession(session)
+				session.handle()
+			}()
+		}
+	}()
+
+	return port, nil
+}
+
+// localStreamSession proxies a single client connection to its own
+// TLS connection to the basestation.
+type localStreamSession struct {
+	proxy  *LocalStreamProxy
+	id     int
+	logger *Logger
+
+	client  net.Conn
+	backend net.Conn
+
+	// the basestation hands out a nonce which must be incremented on
+	// every request, and since each session has its own backend
+	// connection the nonce is tracked per client
+	nonce int
+
+	// media state learned from the RTSP exchange, used to figure out
+	// which interleaved channel carries which track
+	tracks   []*localStreamTrack
+	setups   map[string]string
+	channels map[byte]*localStreamTrack
+
+	// protects nonce and media state
+	lock *sync.Mutex
+}
+
+func (l *LocalStreamProxy) newSession(clientConn net.Conn) *localStreamSession {
+	l.sessionsLock.Lock()
+	defer l.sessionsLock.Unlock()
+
+	l.nextSessionID++
+	session := &localStreamSession{
+		proxy:    l,
+		id:       l.nextSessionID,
+		logger:   l.logger.With(LogFieldSession, strconv.Itoa(l.nextSessionID)),
+		client:   clientConn,
+		setups:   map[string]string{},
+		channels: map[byte]*localStreamTrack{},
+		lock:     &sync.Mutex{},
+	}
+	l.sessions[session] = struct{}{}
+	return session
+}
+
+func (l *LocalStreamProxy) removeSession(session *localStreamSession) {
+	l.sessionsLock.Lock()
+	delete(l.sessions, session)
+	l.sessionsLock.Unlock()
+
+	l.mediaLock.Lock()
+	if l.publisher == session {
+		l.publisher = nil
+		l.publisherTracks = nil
+	}
+	l.mediaLock.Unlock()
+}
+
+// EnableUDPRepublish sends the RTP of the proxied stream to local UDP
+// ports, with RTCP on the next port up. A port of 0 skips that kind of
+// media. Use GetRepublishSDP to get an SDP describing the ports.
+func (l *LocalStreamProxy) EnableUDPRepublish(videoPort, audioPort int) error {
+	u, err := newUDPRepublisher(videoPort, audioPort)
+	if err != nil {
+		return fmt.Errorf("could not create udp republisher: %w", err)
+	}
+	l.addSink("udp", u)
+	l.logger.Info("Republishing video to udp://127.0.0.1:%d and audio to udp://127.0.0.1:%d", videoPort, audioPort)
+	return nil
+}
+
+// StartRecording writes the proxied stream to fragmented MP4 files in
+// dir, starting a new file roughly every segmentSeconds. Recordings older
+// than retentionSeconds are deleted; 0 keeps them forever. Only H.264
+// video and AAC audio are recorded.
+func (l *LocalStreamProxy) StartRecording(dir string, segmentSeconds, retentionSeconds int) error {
+	if segmentSeconds <= 0 {
+		return fmt.Errorf("segment length must be positive")
+	}
+	recorder, err := newFMP4Recorder(l, dir, time.Duration(segmentSeconds)*time.Second, time.Duration(retentionSeconds)*time.Second)
+	if err != nil {
+		return err
+	}
+	l.addSink("recording", newFMP4Segmenter(l, "recording", recorder))
+	l.logger.Info("Recording to %s in %d second segments", dir, segmentSeconds)
+	return nil
+}
+
+// StopRecording stops a recording started by StartRecording, finishing
+// the current file.
+func (l *LocalStreamProxy) StopRecording() {
+	l.removeSink("recording")
+}
+
+// GetSDP returns the SDP most recently sent by the basestation in a
+// DESCRIBE response, or an empty string if there hasn't been one.
+func (l *LocalStreamProxy) GetSDP() string {
+	l.mediaLock.Lock()
+	defer l.mediaLock.Unlock()
+	return l.sdp
+}
+
+// GetRepublishSDP returns the basestation's SDP rewritten to describe
+// the ports set up by EnableUDPRepublish.
+func (l *LocalStreamProxy) GetRepublishSDP() (string, error) {
+	l.mediaLock.Lock()
+	defer l.mediaLock.Unlock()
+
+	u, ok := l.sinks["udp"].(*udpRepublisher)
+	if !ok {
+		return "", fmt.Errorf("udp republishing is not enabled")
+	}
+	if l.sdp == "" {
+		return "", fmt.Errorf("no sdp received from basestation yet")
+	}
+	return u.sdp(l.sdp)
+}
+
+// addSink registers a sink under name, replacing and closing any
+// existing sink with the same name.
+func (l *LocalStreamProxy) addSink(name string, sink localStreamSink) {
+	l.mediaLock.Lock()
+	defer l.mediaLock.Unlock()
+	if old, ok := l.sinks[name]; ok {
+		old.close()
+	}
+	l.sinks[name] = sink
+	if l.publisher != nil {
+		sink.setTracks(l.publisherTracks)
+	}
+}
+
+func (l *LocalStreamProxy) removeSink(name string) {
+	l.mediaLock.Lock()
+	defer l.mediaLock.Unlock()
+	if sink, ok := l.sinks[name]; ok {
+		sink.close()
+		delete(l.sinks, name)
+	}
+}
+
+func (l *LocalStreamProxy) dispatchMedia(session *localStreamSession, tracks []*localStreamTrack, track *localStreamTrack, isRTCP bool, payload []byte) {
+	l.mediaLock.Lock()
+	defer l.mediaLock.Unlock()
+
+	if l.publisher == nil {
+		l.publisher = session
+		l.publisherTracks = tracks
+		session.logger.Info("Publishing media to local sinks")
+		for _, sink := range l.sinks {
+			sink.setTracks(tracks)
+		}
+	}
+	if l.publisher != session {
+		return
+	}
+
+	for _, sink := range l.sinks {
+		sink.writePacket(track, isRTCP, payload)
+	}
+}
+
+// handleResponseMedia records media state from a basestation response.
+func (s *localStreamSession) handleResponseMedia(rr *rtsp.Response, raw []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if strings.HasPrefix(rr.Header.Get("Content-Type"), "application/sdp") {
+		sdp := string(rtspBody(raw))
+		tracks, err := parseLocalStreamSDP(sdp)
 		if err != nil {
-			l.Info("Error accepting connection: %s", err)
+			s.logger.Info("Could not parse sdp: %s", err)
+		} else {
+			s.tracks = tracks
+			s.proxy.mediaLock.Lock()
+			s.proxy.sdp = sdp
+			s.proxy.mediaLock.Unlock()
+		}
+	}
+
+	cseq := rr.Header.Get("CSeq")
+	url, ok := s.setups[cseq]
+	if !ok {
+		return
+	}
+	delete(s.setups, cseq)
+
+	channel, ok := parseInterleavedChannel(rr.Header.Get("Transport"))
+	if !ok {
+		return
+	}
+	for _, track := range s.tracks {
+		if track.matches(url) {
+			s.channels[channel] = track
+			s.logger.Debug("Interleaved channel %d carries %s %s", channel, track.kind, track.codec)
 			return
 		}
+	}
+}
 
-		l.handleClient(clientConn)
-	}()
+// handleInterleaved passes RTP and RTCP from the basestation to the proxy's sinks.
+func (s *localStreamSession) handleInterleaved(msg *rtspMessage) {
+	s.lock.Lock()
+	tracks := s.tracks
+	track, isRTCP := s.channels[msg.channel], false
+	if track == nil && msg.channel > 0 {
+		track = s.channels[msg.channel-1]
+		isRTCP = track != nil
+	}
+	s.lock.Unlock()
 
-	return port, nil
+	if track != nil {
+		s.proxy.dispatchMedia(s, tracks, track, isRTCP, msg.payload)
+	}
 }
 
-const (
-	cBufferLen = 4096
-	sBufferLen = 40960
-)
+func (s *localStreamSession) close() {
+	s.client.Close()
+	if s.backend != nil {
+		s.backend.Close()
+	}
+}
 
-func (l *LocalStreamProxy) handleClient(clientConn net.Conn) {
+func (s *localStreamSession) handle() {
+	l := s.proxy
+	clientConn := s.client
 	defer clientConn.Close()
 
 	// Connect to the backend server
-	backendConn, err := tls.Dial("tcp", fmt.Sprintf("%s:554", l.basestationIP), l.tlsConfig)
+	tlsConfig, err := l.basestationTLSConfig()
+	if err != nil {
+		s.logger.Info("Failed to connect to the backend server: %s", err)
+		return
+	}
+	backendConn, err := tls.Dial("tcp", fmt.Sprintf("%s:554", l.basestationIP), tlsConfig)
 	if err != nil {
-		l.Info("Failed to connect to the backend server: %s", err)
+		s.logger.Info("Failed to connect to the backend server: %s", err)
 		return
 	}
-	l.backend = backendConn
+	l.sessionsLock.Lock()
+	s.backend = backendConn
+	l.sessionsLock.Unlock()
 	defer backendConn.Close()
 
-	l.Info("Proxying from %s to %s", clientConn.RemoteAddr(), backendConn.RemoteAddr())
-
-	cBuffer := make([]byte, cBufferLen)
-	sBuffer := make([]byte, sBufferLen)
-	nonce := 0
+	s.logger.Info("Proxying from %s to %s", clientConn.RemoteAddr(), backendConn.RemoteAddr())
 
 	go func() {
 		defer backendConn.Close()
 		defer clientConn.Close()
+
+		server := newRTSPStreamReader(backendConn)
 		for {
-			// Read data from the server
-			n, err := backendConn.Read(sBuffer)
+			// Read the next message from the server
+			msg, err := server.next()
 			if err != nil {
-				l.Info("Error reading from server: %s", err)
+				s.logger.Info("Error reading from server: %s", err)
 				break
 			}
 
-			if l.extraVerbose {
-				l.Debug("Received %d bytes from server", n)
-			}
+			s.logger.Trace("Received %d bytes from server", len(msg.raw))
 
-			if n == sBufferLen {
-				l.Info("Warning: local stream server buffer may be too small")
-			}
-
-			if n < 4 || string(sBuffer[:4]) != "RTSP" {
-				if l.extraVerbose {
-					l.Debug("Non-RTSP packet")
-				}
-				_, err = clientConn.Write(sBuffer[:n])
+			if msg.interleaved {
+				s.handleInterleaved(msg)
+				_, err = clientConn.Write(msg.raw)
 				if err != nil {
-					l.Info("Error writing to client: %s", err)
+					s.logger.Info("Error writing to client: %s", err)
 					break
 				}
 				continue
 			}
 
-			rr, err := rtsp.ReadResponse(bytes.NewBuffer(sBuffer))
+			rr, err := rtsp.ReadResponse(bytes.NewReader(msg.raw))
 			if err != nil {
 				if err == rtsp.NOT_RTSP_PACKET {
-					if l.extraVerbose {
-						l.Debug("Non-RTSP packet")
-					}
-					_, err = clientConn.Write(sBuffer[:n])
+					// most likely a request from the server, which we
+					// have no reason to rewrite
+					s.logger.Trace("Non-RTSP response")
+					_, err = clientConn.Write(msg.raw)
 					if err != nil {
-						l.Info("Error writing to client: %s", err)
+						s.logger.Info("Error writing to client: %s", err)
 						break
 					}
 					continue
 				}
-				l.Info("Error parsing rtsp response: %s", err)
+				s.logger.Info("Error parsing rtsp response: %s", err)
 				break
 			}
 
 			if rr.Header.Get("Nonce") != "" {
-				nonce, err = strconv.Atoi(rr.Header.Get("Nonce"))
+				nonce, err := strconv.Atoi(rr.Header.Get("Nonce"))
 				if err != nil {
-					l.Info("Error parsing nonce: %s", err)
+					s.logger.Info("Error parsing nonce: %s", err)
 					break
 				}
+				s.lock.Lock()
+				s.nonce = nonce
+				s.lock.Unlock()
 			}
 
-			s := rr.String()
-			s = strings.ReplaceAll(s, "Cseq:", "CSeq:")
-			s = strings.ReplaceAll(s, "Rtp-Info:", "RTP-Info:")
-			l.Debug("Incoming:\n%s", s)
+			s.handleResponseMedia(rr, msg.raw)
+
+			str := rr.String()
+			str = strings.ReplaceAll(str, "Cseq:", "CSeq:")
+			str = strings.ReplaceAll(str, "Rtp-Info:", "RTP-Info:")
+			s.logger.Debug("Incoming:\n%s", str)
 
 			// Forward the data to the client
-			_, err = clientConn.Write([]byte(s))
+			_, err = clientConn.Write([]byte(str))
 			if err != nil {
-				l.Info("Error writing to client: %s", err)
+				s.logger.Info("Error writing to client: %s", err)
 				break
 			}
 		}
 	}()
 
+	client := newRTSPStreamReader(clientConn)
 	for {
-		// Read data from the client
-		n, err := clientConn.Read(cBuffer)
+		// Read the next message from the client
+		msg, err := client.next()
 		if err != nil {
-			l.Info("Error reading from client: %s", err)
+			s.logger.Info("Error reading from client: %s", err)
 			break
 		}
 
-		if l.extraVerbose {
-			l.Debug("Received %d bytes from client", n)
-		}
+		s.logger.Trace("Received %d bytes from client", len(msg.raw))
 
-		if n == cBufferLen {
-			l.Info("Warning: local stream client buffer may be too small")
+		if msg.interleaved {
+			// e.g. RTCP receiver reports, which need no rewriting
+			_, err = backendConn.Write(msg.raw)
+			if err != nil {
+				s.logger.Info("Error writing to backend: %s", err)
+				break
+			}
+			continue
 		}
 
-		rr, err := rtsp.ReadRequest(bytes.NewBuffer(cBuffer))
+		rr, err := rtsp.ReadRequest(bytes.NewReader(msg.raw))
 		if err != nil {
-			l.Info("Error parsing rtsp request: %s", err)
+			s.logger.Info("Error parsing rtsp request: %s", err)
 			break
 		}
 
-		if nonce != 0 {
-			nonce += 1
-			rr.Header.Add("Nonce", fmt.Sprintf("%d", nonce))
+		s.lock.Lock()
+		if s.nonce != 0 {
+			s.nonce += 1
+			rr.Header.Add("Nonce", fmt.Sprintf("%d", s.nonce))
+		}
+		if rr.Method == rtsp.SETUP {
+			s.setups[rr.Header.Get("CSeq")] = rr.URL.String()
 		}
+		s.lock.Unlock()
 
-		s := rr.String()
-		s = strings.ReplaceAll(s, fmt.Sprintf("rtsp://localhost:%d", l.listenerPort), fmt.Sprintf("rtsp://%s", l.basestationHostname))
-		s = strings.ReplaceAll(s, "Cseq:", "CSeq:")
-		l.Debug("Outgoing:\n%s", s)
+		str := rr.String()
+		str = strings.ReplaceAll(str, fmt.Sprintf("rtsp://localhost:%d", l.listenerPort), fmt.Sprintf("rtsp://%s", l.basestationHostname))
+		str = strings.ReplaceAll(str, "Cseq:", "CSeq:")
+		s.logger.Debug("Outgoing:\n%s", str)
 
 		// Forward the data to the backend
-		_, err = backendConn.Write([]byte(s))
+		_, err = backendConn.Write([]byte(str))
 		if err != nil {
-			l.Info("Error writing to backend: %s", err)
+			s.logger.Info("Error writing to backend: %s", err)
 			break
 		}
 	}
@@ -246,7 +582,21 @@ func (l *LocalStreamProxy) Close() {
 	if l.listener != nil {
 		l.listener.Close()
 	}
-	if l.backend != nil {
-		l.backend.Close()
+
+	l.sessionsLock.Lock()
+	for session := range l.sessions {
+		session.close()
 	}
+	l.sessionsLock.Unlock()
+
+	l.StopHLS()
+
+	l.mediaLock.Lock()
+	defer l.mediaLock.Unlock()
+	for name, sink := range l.sinks {
+		sink.close()
+		delete(l.sinks, name)
+	}
+
+	l.logger.Close()
 }
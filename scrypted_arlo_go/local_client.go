@@ -0,0 +1,279 @@
+package scrypted_arlo_go
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beatgammit/rtsp"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// how often a playing localStreamClient pings the basestation so
+	// that its RTSP session doesn't time out
+	localStreamKeepAliveInterval = 30 * time.Second
+
+	localStreamDialTimeout = 10 * time.Second
+)
+
+// localStreamClient is an RTSP client of the basestation, used when the
+// library itself consumes a stream rather than proxying one for an
+// external client. Media is always requested interleaved over the same
+// TLS connection.
+type localStreamClient struct {
+	proxy  *LocalStreamProxy
+	name   string
+	url    string
+	logger *Logger
+
+	conn   net.Conn
+	reader *rtspStreamReader
+
+	tracks   []*localStreamTrack
+	channels map[byte]*localStreamTrack
+	session  string
+
+	// protects cseq, nonce and writes to conn, since keepalives are
+	// sent while another goroutine is reading media
+	cseq  int
+	nonce int
+	lock  *sync.Mutex
+
+	closeOnce *sync.Once
+	closed    chan struct{}
+}
+
+func (l *LocalStreamProxy) newLocalStreamClient(name, streamPath string) (*localStreamClient, error) {
+	tlsConfig, err := l.basestationTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: localStreamDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", fmt.Sprintf("%s:554", l.basestationIP), tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to basestation: %w", err)
+	}
+
+	return &localStreamClient{
+		proxy:     l,
+		name:      name,
+		logger:    l.logger.With("stream", name),
+		url:       fmt.Sprintf("rtsp://%s/%s", l.basestationHostname, strings.TrimPrefix(streamPath, "/")),
+		conn:      conn,
+		reader:    newRTSPStreamReader(conn),
+		channels:  map[byte]*localStreamTrack{},
+		lock:      &sync.Mutex{},
+		closeOnce: &sync.Once{},
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+func (c *localStreamClient) send(method, url string, headers map[string]string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.cseq++
+	req, err := rtsp.NewRequest(method, url, strconv.Itoa(c.cseq), nil)
+	if err != nil {
+		return fmt.Errorf("could not create %s request: %w", method, err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if c.session != "" {
+		req.Header.Set("Session", c.session)
+	}
+	if c.nonce != 0 {
+		c.nonce += 1
+		req.Header.Set("Nonce", strconv.Itoa(c.nonce))
+	}
+
+	str := strings.ReplaceAll(req.String(), "Cseq:", "CSeq:")
+	c.logger.Debug("Outgoing:\n%s", str)
+	if _, err := c.conn.Write([]byte(str)); err != nil {
+		return fmt.Errorf("could not send %s request: %w", method, err)
+	}
+	return nil
+}
+
+// parseResponse records any nonce handed out by the basestation.
+func (c *localStreamClient) parseResponse(raw []byte) (*rtsp.Response, error) {
+	rr, err := rtsp.ReadResponse(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse rtsp response: %w", err)
+	}
+	if rr.Header.Get("Nonce") != "" {
+		nonce, err := strconv.Atoi(rr.Header.Get("Nonce"))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse nonce: %w", err)
+		}
+		c.lock.Lock()
+		c.nonce = nonce
+		c.lock.Unlock()
+	}
+	return rr, nil
+}
+
+// request sends a request and waits for its response. It must not be used
+// once media is flowing; see readMedia.
+func (c *localStreamClient) request(method, url string, headers map[string]string) (*rtsp.Response, []byte, error) {
+	if err := c.send(method, url, headers); err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		msg, err := c.reader.next()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read %s response: %w", method, err)
+		}
+		if msg.interleaved {
+			// stray media from an earlier PLAY
+			continue
+		}
+
+		rr, err := c.parseResponse(msg.raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.logger.Debug("Incoming:\n%s", strings.ReplaceAll(rr.String(), "Cseq:", "CSeq:"))
+		if rr.StatusCode != rtsp.OK {
+			return nil, nil, fmt.Errorf("%s failed: %d %s", method, rr.StatusCode, rr.Status)
+		}
+		return rr, rtspBody(msg.raw), nil
+	}
+}
+
+// trackURL resolves a track's control attribute against the base URL.
+func (c *localStreamClient) trackURL(base string, track *localStreamTrack) string {
+	if track.control == "" || track.control == "*" {
+		return base
+	}
+	if strings.HasPrefix(track.control, "rtsp://") {
+		return track.control
+	}
+	return strings.TrimSuffix(base, "/") + "/" + track.control
+}
+
+// play runs DESCRIBE, SETUP for each track matching kinds (all tracks if
+// empty) and PLAY.
+func (c *localStreamClient) play(kinds ...string) error {
+	if _, _, err := c.request(rtsp.OPTIONS, c.url, nil); err != nil {
+		return err
+	}
+
+	rr, body, err := c.request(rtsp.DESCRIBE, c.url, map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return err
+	}
+	tracks, err := parseLocalStreamSDP(string(body))
+	if err != nil {
+		return err
+	}
+
+	base := c.url
+	if contentBase := rr.Header.Get("Content-Base"); contentBase != "" {
+		base = contentBase
+	}
+
+	channel := byte(0)
+	for _, track := range tracks {
+		if len(kinds) > 0 && !slices.Contains(kinds, track.kind) {
+			continue
+		}
+
+		transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1)
+		rr, _, err := c.request(rtsp.SETUP, c.trackURL(base, track), map[string]string{"Transport": transport})
+		if err != nil {
+			return err
+		}
+
+		if c.session == "" {
+			// strip parameters such as timeout
+			session, _, _ := strings.Cut(rr.Header.Get("Session"), ";")
+			c.session = strings.TrimSpace(session)
+		}
+		if ch, ok := parseInterleavedChannel(rr.Header.Get("Transport")); ok {
+			channel = ch
+		}
+		c.channels[channel] = track
+		c.tracks = append(c.tracks, track)
+		channel += 2
+	}
+	if len(c.tracks) == 0 {
+		return fmt.Errorf("no matching tracks in stream")
+	}
+
+	if _, _, err := c.request(rtsp.PLAY, base, map[string]string{"Range": "npt=0.000-"}); err != nil {
+		return err
+	}
+
+	go c.keepAlive()
+	return nil
+}
+
+func (c *localStreamClient) keepAlive() {
+	ticker := time.NewTicker(localStreamKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			// the response is consumed by readMedia
+			if err := c.send(rtsp.OPTIONS, c.url, nil); err != nil {
+				c.logger.Warn("Could not send keepalive: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// readMedia hands RTP and RTCP to handle until the connection fails or the
+// client is closed.
+func (c *localStreamClient) readMedia(handle func(track *localStreamTrack, isRTCP bool, payload []byte)) error {
+	for {
+		msg, err := c.reader.next()
+		if err != nil {
+			select {
+			case <-c.closed:
+				return nil
+			default:
+				return fmt.Errorf("could not read from basestation: %w", err)
+			}
+		}
+
+		if !msg.interleaved {
+			if _, err := c.parseResponse(msg.raw); err != nil {
+				c.logger.Debug("%s", err)
+			}
+			continue
+		}
+
+		track, isRTCP := c.channels[msg.channel], false
+		if track == nil && msg.channel > 0 {
+			track = c.channels[msg.channel-1]
+			isRTCP = track != nil
+		}
+		if track != nil {
+			handle(track, isRTCP, msg.payload)
+		}
+	}
+}
+
+func (c *localStreamClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.session != "" {
+			c.send(rtsp.TEARDOWN, c.url, nil)
+		}
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,328 @@
+package scrypted_arlo_go
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// number of segments listed in the playlist
+	hlsPlaylistLength = 6
+
+	// how long to wait before reconnecting to the basestation
+	hlsReconnectDelay = 5 * time.Second
+)
+
+type hlsSegment struct {
+	sequence int
+	initID   int
+	duration time.Duration
+	data     []byte
+}
+
+// hlsPlaylist is an fmp4SegmentHandler that groups fragments into HLS
+// segments of roughly segmentDuration and keeps a sliding window of them.
+type hlsPlaylist struct {
+	segmentDuration time.Duration
+
+	inits    map[int][]byte
+	initID   int
+	segments []*hlsSegment
+	pending  *hlsSegment
+	nextSeq  int
+
+	// discontinuities that have slid out of the window
+	discontinuities int
+
+	lock *sync.Mutex
+}
+
+func newHLSPlaylist(segmentDuration time.Duration) *hlsPlaylist {
+	return &hlsPlaylist{
+		segmentDuration: segmentDuration,
+		inits:           map[int][]byte{},
+		lock:            &sync.Mutex{},
+	}
+}
+
+func (h *hlsPlaylist) onInit(init []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// fragments for the previous init can't be mixed with the new one
+	h.finishPending()
+	h.initID++
+	h.inits[h.initID] = init
+}
+
+func (h *hlsPlaylist) onFragment(fragment []byte, duration time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.pending == nil {
+		h.pending = &hlsSegment{initID: h.initID}
+	}
+	h.pending.data = append(h.pending.data, fragment...)
+	h.pending.duration += duration
+
+	if h.pending.duration >= h.segmentDuration {
+		h.finishPending()
+	}
+}
+
+func (h *hlsPlaylist) finishPending() {
+	if h.pending == nil {
+		return
+	}
+	h.pending.sequence = h.nextSeq
+	h.nextSeq++
+	h.segments = append(h.segments, h.pending)
+	h.pending = nil
+
+	for len(h.segments) > hlsPlaylistLength {
+		if h.segments[1].initID != h.segments[0].initID {
+			h.discontinuities++
+		}
+		h.segments = h.segments[1:]
+	}
+
+	// forget init segments no longer referenced
+	for id := range h.inits {
+		if id < h.segments[0].initID {
+			delete(h.inits, id)
+		}
+	}
+}
+
+func (h *hlsPlaylist) close() {}
+
+func (h *hlsPlaylist) playlist() (string, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.segments) == 0 {
+		return "", false
+	}
+
+	targetDuration := 1
+	for _, segment := range h.segments {
+		if d := int(math.Ceil(segment.duration.Seconds())); d > targetDuration {
+			targetDuration = d
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n")
+	fmt.Fprintf(&b, "#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", h.segments[0].sequence)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", h.discontinuities)
+	fmt.Fprintf(&b, "#EXT-X-INDEPENDENT-SEGMENTS\n")
+	for i, segment := range h.segments {
+		if i == 0 || segment.initID != h.segments[i-1].initID {
+			if i > 0 {
+				fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY\n")
+			}
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init%d.mp4\"\n", segment.initID)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", segment.duration.Seconds())
+		fmt.Fprintf(&b, "segment%d.m4s\n", segment.sequence)
+	}
+	return b.String(), true
+}
+
+func (h *hlsPlaylist) init(id int) ([]byte, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	init, ok := h.inits[id]
+	return init, ok
+}
+
+func (h *hlsPlaylist) segment(sequence int) ([]byte, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, segment := range h.segments {
+		if segment.sequence == sequence {
+			return segment.data, true
+		}
+	}
+	return nil, false
+}
+
+func (h *hlsPlaylist) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var (
+		data        []byte
+		ok          bool
+		id          int
+		contentType string
+	)
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case name == "stream.m3u8":
+		var playlist string
+		playlist, ok = h.playlist()
+		data, contentType = []byte(playlist), "application/vnd.apple.mpegurl"
+		w.Header().Set("Cache-Control", "no-cache")
+	case strings.HasPrefix(name, "init"):
+		if _, err := fmt.Sscanf(name, "init%d.mp4", &id); err == nil {
+			data, ok = h.init(id)
+		}
+		contentType = "video/mp4"
+	case strings.HasPrefix(name, "segment"):
+		if _, err := fmt.Sscanf(name, "segment%d.m4s", &id); err == nil {
+			data, ok = h.segment(id)
+		}
+		contentType = "video/iso.segment"
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// localHLSOutput pulls a stream from the basestation and serves it as HLS
+// on a localhost HTTP port, reconnecting until stopped.
+type localHLSOutput struct {
+	proxy      *LocalStreamProxy
+	streamPath string
+	playlist   *hlsPlaylist
+	segmenter  *fmp4Segmenter
+
+	listener net.Listener
+	server   *http.Server
+
+	client *localStreamClient
+	lock   *sync.Mutex
+
+	closeOnce *sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+func (o *localHLSOutput) run() {
+	defer close(o.done)
+
+	for {
+		if err := o.stream(); err != nil {
+			o.proxy.logger.Warn("HLS stream from %s failed: %s", o.streamPath, err)
+		}
+
+		select {
+		case <-o.closed:
+			return
+		case <-time.After(hlsReconnectDelay):
+		}
+	}
+}
+
+func (o *localHLSOutput) stream() error {
+	client, err := o.proxy.newLocalStreamClient("hls", o.streamPath)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+
+	o.lock.Lock()
+	select {
+	case <-o.closed:
+		o.lock.Unlock()
+		return nil
+	default:
+	}
+	o.client = client
+	o.lock.Unlock()
+
+	if err := client.play(); err != nil {
+		return err
+	}
+	o.segmenter.setTracks(client.tracks)
+
+	return client.readMedia(o.segmenter.writePacket)
+}
+
+func (o *localHLSOutput) close() {
+	o.closeOnce.Do(func() {
+		o.lock.Lock()
+		close(o.closed)
+		if o.client != nil {
+			o.client.close()
+		}
+		o.lock.Unlock()
+
+		<-o.done
+		o.server.Close()
+		o.segmenter.close()
+	})
+}
+
+// StartHLS serves the stream at streamPath on the basestation as HLS with
+// fragmented MP4 segments of roughly segmentSeconds, returning the port of
+// the local HTTP server. The playlist is at /stream.m3u8 and becomes
+// available once the first segment is complete. Only one HLS output can
+// run at a time; starting another replaces it.
+func (l *LocalStreamProxy) StartHLS(streamPath string, segmentSeconds int) (port int, err error) {
+	if segmentSeconds <= 0 {
+		return 0, fmt.Errorf("segment length must be positive")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("error creating HLS listener: %w", err)
+	}
+
+	playlist := newHLSPlaylist(time.Duration(segmentSeconds) * time.Second)
+	output := &localHLSOutput{
+		proxy:      l,
+		streamPath: streamPath,
+		playlist:   playlist,
+		segmenter:  newFMP4Segmenter(l, "hls", playlist),
+		listener:   listener,
+		server:     &http.Server{Handler: playlist},
+		lock:       &sync.Mutex{},
+		closeOnce:  &sync.Once{},
+		closed:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	go func() {
+		if err := output.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.logger.Info("HLS server error: %s", err)
+		}
+	}()
+	go output.run()
+
+	l.mediaLock.Lock()
+	old := l.hls
+	l.hls = output
+	l.mediaLock.Unlock()
+	if old != nil {
+		old.close()
+	}
+
+	port = listener.Addr().(*net.TCPAddr).Port
+	l.logger.Info("Serving HLS for %s on http://127.0.0.1:%d/stream.m3u8", streamPath, port)
+	return port, nil
+}
+
+// StopHLS stops the HLS output started by StartHLS.
+func (l *LocalStreamProxy) StopHLS() {
+	l.mediaLock.Lock()
+	output := l.hls
+	l.hls = nil
+	l.mediaLock.Unlock()
+
+	if output != nil {
+		output.close()
+	}
+}
@@ -0,0 +1,245 @@
+package scrypted_arlo_go
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	pionsdp "github.com/pion/sdp/v3"
+)
+
+// localStreamTrack describes one media stream announced in the
+// basestation's DESCRIBE response.
+type localStreamTrack struct {
+	kind        string // "video" or "audio"
+	control     string
+	payloadType uint8
+	codec       string // encoding name from rtpmap, e.g. "H264"
+	clockRate   uint32
+	channels    int
+	fmtp        string
+}
+
+func parseLocalStreamSDP(sdp string) ([]*localStreamTrack, error) {
+	sd := &pionsdp.SessionDescription{}
+	if err := sd.Unmarshal([]byte(sdp)); err != nil {
+		return nil, fmt.Errorf("could not parse sdp: %w", err)
+	}
+
+	tracks := []*localStreamTrack{}
+	for _, md := range sd.MediaDescriptions {
+		if len(md.MediaName.Formats) == 0 {
+			continue
+		}
+		pt, err := strconv.Atoi(md.MediaName.Formats[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse payload type %q: %w", md.MediaName.Formats[0], err)
+		}
+
+		track := &localStreamTrack{
+			kind:        md.MediaName.Media,
+			payloadType: uint8(pt),
+			channels:    1,
+		}
+		track.control, _ = md.Attribute("control")
+
+		for _, attr := range md.Attributes {
+			prefix := md.MediaName.Formats[0] + " "
+			if !strings.HasPrefix(attr.Value, prefix) {
+				continue
+			}
+			value := strings.TrimPrefix(attr.Value, prefix)
+			switch attr.Key {
+			case "rtpmap":
+				// <encoding name>/<clock rate>[/<channels>]
+				tokens := strings.Split(value, "/")
+				track.codec = tokens[0]
+				if len(tokens) > 1 {
+					clockRate, err := strconv.Atoi(tokens[1])
+					if err != nil {
+						return nil, fmt.Errorf("could not parse clock rate in %q: %w", value, err)
+					}
+					track.clockRate = uint32(clockRate)
+				}
+				if len(tokens) > 2 {
+					if channels, err := strconv.Atoi(tokens[2]); err == nil {
+						track.channels = channels
+					}
+				}
+			case "fmtp":
+				track.fmtp = value
+			}
+		}
+
+		tracks = append(tracks, track)
+	}
+
+	return tracks, nil
+}
+
+// matches reports whether a SETUP request for url refers to this track.
+// Controls may be absolute or relative to the presentation URL, and
+// the URL may or may not have been rewritten by the proxy yet.
+func (t *localStreamTrack) matches(url string) bool {
+	if t.control == "" || t.control == "*" {
+		return false
+	}
+	if strings.HasPrefix(t.control, "rtsp://") {
+		_, control, _ := strings.Cut(strings.TrimPrefix(t.control, "rtsp://"), "/")
+		_, path, _ := strings.Cut(strings.TrimPrefix(url, "rtsp://"), "/")
+		return control == path
+	}
+	return strings.HasSuffix(url, "/"+t.control) || url == t.control
+}
+
+// fmtpParam returns the named parameter from the track's fmtp line.
+func (t *localStreamTrack) fmtpParam(name string) string {
+	for _, param := range strings.Split(t.fmtp, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if ok && strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+var interleavedRegexp = regexp.MustCompile(`interleaved=(\d+)`)
+
+// parseInterleavedChannel extracts the RTP channel from a Transport header.
+// RTCP is sent on the following channel.
+func parseInterleavedChannel(transport string) (byte, bool) {
+	match := interleavedRegexp.FindStringSubmatch(transport)
+	if match == nil {
+		return 0, false
+	}
+	channel, err := strconv.Atoi(match[1])
+	if err != nil || channel > 255 {
+		return 0, false
+	}
+	return byte(channel), true
+}
+
+// rtspBody returns the body of a raw RTSP message.
+func rtspBody(raw []byte) []byte {
+	idx := bytes.Index(raw, []byte("\r\n\r\n"))
+	if idx < 0 {
+		return nil
+	}
+	return raw[idx+4:]
+}
+
+// localStreamSink consumes media demuxed from the basestation stream.
+// setTracks is called before any packets are written, and again whenever
+// a different session starts publishing.
+type localStreamSink interface {
+	setTracks(tracks []*localStreamTrack)
+	writePacket(track *localStreamTrack, isRTCP bool, payload []byte)
+	close()
+}
+
+// udpRepublisher sends RTP to a local UDP port per media kind, with RTCP
+// on the port immediately above it, following the usual RTP convention.
+type udpRepublisher struct {
+	ports map[string]int
+	rtp   map[string]*net.UDPConn
+	rtcp  map[string]*net.UDPConn
+}
+
+func newUDPRepublisher(videoPort, audioPort int) (*udpRepublisher, error) {
+	u := &udpRepublisher{
+		ports: map[string]int{},
+		rtp:   map[string]*net.UDPConn{},
+		rtcp:  map[string]*net.UDPConn{},
+	}
+
+	for kind, port := range map[string]int{"video": videoPort, "audio": audioPort} {
+		if port <= 0 {
+			continue
+		}
+
+		rtpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+		if err != nil {
+			u.close()
+			return nil, err
+		}
+		u.rtp[kind] = rtpConn
+
+		rtcpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port + 1})
+		if err != nil {
+			u.close()
+			return nil, err
+		}
+		u.rtcp[kind] = rtcpConn
+		u.ports[kind] = port
+	}
+
+	return u, nil
+}
+
+func (u *udpRepublisher) setTracks(tracks []*localStreamTrack) {}
+
+func (u *udpRepublisher) writePacket(track *localStreamTrack, isRTCP bool, payload []byte) {
+	conns := u.rtp
+	if isRTCP {
+		conns = u.rtcp
+	}
+	if conn, ok := conns[track.kind]; ok {
+		// nobody listening is not an error worth reporting, since the
+		// consumer may not have started yet
+		conn.Write(payload)
+	}
+}
+
+func (u *udpRepublisher) close() {
+	for _, conn := range u.rtp {
+		conn.Close()
+	}
+	for _, conn := range u.rtcp {
+		conn.Close()
+	}
+}
+
+// sdp rewrites the basestation's SDP to point at the republished ports.
+func (u *udpRepublisher) sdp(original string) (string, error) {
+	sd := &pionsdp.SessionDescription{}
+	if err := sd.Unmarshal([]byte(original)); err != nil {
+		return "", fmt.Errorf("could not parse sdp: %w", err)
+	}
+
+	localhost := &pionsdp.ConnectionInformation{
+		NetworkType: "IN",
+		AddressType: "IP4",
+		Address:     &pionsdp.Address{Address: "127.0.0.1"},
+	}
+	sd.ConnectionInformation = localhost
+
+	medias := []*pionsdp.MediaDescription{}
+	for _, md := range sd.MediaDescriptions {
+		port, ok := u.ports[md.MediaName.Media]
+		if !ok {
+			continue
+		}
+		md.MediaName.Port = pionsdp.RangedPort{Value: port}
+		md.MediaName.Protos = []string{"RTP", "AVP"}
+		md.ConnectionInformation = localhost
+
+		attrs := []pionsdp.Attribute{}
+		for _, attr := range md.Attributes {
+			if attr.Key != "control" {
+				attrs = append(attrs, attr)
+			}
+		}
+		md.Attributes = attrs
+		medias = append(medias, md)
+	}
+	sd.MediaDescriptions = medias
+
+	out, err := sd.Marshal()
+	if err != nil {
+		return "", fmt.Errorf("could not marshal sdp: %w", err)
+	}
+	return string(out), nil
+}
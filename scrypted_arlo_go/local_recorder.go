@@ -0,0 +1,127 @@
+package scrypted_arlo_go
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	recordingPrefix = "segment-"
+	recordingSuffix = ".mp4"
+)
+
+// fmp4Recorder writes fragments to a rolling set of self-contained MP4
+// files in dir. Each file starts with the init segment, and a new file is
+// started at the first fragment boundary after segmentDuration. Files
+// older than retention are deleted, unless retention is zero.
+type fmp4Recorder struct {
+	proxy           *LocalStreamProxy
+	dir             string
+	segmentDuration time.Duration
+	retention       time.Duration
+
+	init         []byte
+	file         *os.File
+	fileDuration time.Duration
+}
+
+func newFMP4Recorder(proxy *LocalStreamProxy, dir string, segmentDuration, retention time.Duration) (*fmp4Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create recording directory: %w", err)
+	}
+	return &fmp4Recorder{
+		proxy:           proxy,
+		dir:             dir,
+		segmentDuration: segmentDuration,
+		retention:       retention,
+	}, nil
+}
+
+func (r *fmp4Recorder) onInit(init []byte) {
+	r.init = init
+	// the new init segment can't be appended to the current file
+	r.closeFile()
+}
+
+func (r *fmp4Recorder) onFragment(fragment []byte, duration time.Duration) {
+	if r.file == nil || r.fileDuration >= r.segmentDuration {
+		if err := r.rotate(); err != nil {
+			r.proxy.logger.Warn("Could not start recording segment: %s", err)
+			return
+		}
+	}
+
+	if _, err := r.file.Write(fragment); err != nil {
+		r.proxy.logger.Warn("Could not write recording segment: %s", err)
+		r.closeFile()
+		return
+	}
+	r.fileDuration += duration
+}
+
+func (r *fmp4Recorder) rotate() error {
+	r.closeFile()
+
+	name := recordingPrefix + time.Now().UTC().Format("20060102T150405.000") + recordingSuffix
+	file, err := os.Create(filepath.Join(r.dir, name))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(r.init); err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.fileDuration = 0
+	r.proxy.logger.Debug("Recording to %s", file.Name())
+
+	r.prune()
+	return nil
+}
+
+// prune deletes expired recordings. Only files that look like ours are
+// considered, so that pointing the recorder at a shared directory is safe.
+func (r *fmp4Recorder) prune() {
+	if r.retention <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		r.proxy.logger.Warn("Could not list recordings: %s", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-r.retention)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, recordingPrefix) || !strings.HasSuffix(name, recordingSuffix) {
+			continue
+		}
+		path := filepath.Join(r.dir, name)
+		if r.file != nil && path == r.file.Name() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			r.proxy.logger.Warn("Could not delete expired recording %s: %s", name, err)
+		}
+	}
+}
+
+func (r *fmp4Recorder) closeFile() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+func (r *fmp4Recorder) close() {
+	r.closeFile()
+}
@@ -0,0 +1,447 @@
+package scrypted_arlo_go
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	fmp4VideoTrackID = 1
+	fmp4AudioTrackID = 2
+
+	// packets queued for the segmenter goroutine before we start dropping
+	segmenterQueueSize = 1024
+)
+
+// fmp4SegmentHandler consumes the output of an fmp4Segmenter. onInit is
+// called whenever the codec parameters change, and is always followed by
+// fragments that can be decoded using it. Every fragment starts with a
+// keyframe.
+type fmp4SegmentHandler interface {
+	onInit(init []byte)
+	onFragment(fragment []byte, duration time.Duration)
+	close()
+}
+
+type segmenterInput struct {
+	track    *localStreamTrack
+	payload  []byte
+	received time.Time
+}
+
+// segmenterTrack holds per-track depacketizing and timing state.
+type segmenterTrack struct {
+	source *localStreamTrack
+	fmp4   *fmp4Track
+
+	h264 *h264Depacketizer
+	aac  *aacDepacketizer
+
+	// timestamps are unwrapped to 64 bits and made relative to base,
+	// which is at start in the fragments' timeline
+	started bool
+	base    uint64
+	start   uint64
+	lastTS  uint32
+	wraps   uint64
+}
+
+// dts returns the decode timestamp of ts, and false if it is from before
+// the start of the timeline.
+func (t *segmenterTrack) dts(ts uint32) (uint64, bool) {
+	unwrapped := t.unwrap(ts)
+	if unwrapped < t.base {
+		return 0, false
+	}
+	return unwrapped - t.base + t.start, true
+}
+
+func (t *segmenterTrack) unwrap(ts uint32) uint64 {
+	if !t.started {
+		t.lastTS = ts
+		t.started = true
+	}
+	if ts > t.lastTS && ts-t.lastTS > 1<<31 && t.wraps > 0 {
+		// a late packet from before the last wrap
+		return (t.wraps-1)<<32 | uint64(ts)
+	}
+	if ts < t.lastTS && t.lastTS-ts > 1<<31 {
+		t.wraps++
+	}
+	t.lastTS = ts
+	return t.wraps<<32 | uint64(ts)
+}
+
+// fmp4Segmenter is a localStreamSink that turns H.264 and AAC RTP into
+// fragmented MP4, with one fragment per GOP. Packets are processed on a
+// separate goroutine so that a slow handler never stalls the proxy.
+type fmp4Segmenter struct {
+	logger  *Logger
+	handler fmp4SegmentHandler
+
+	input   chan segmenterInput
+	done    chan struct{}
+	dropped int
+
+	// the latest tracks from setTracks, picked up by run before the next
+	// packet. tracksChanged holds a signal while they are pending
+	tracksLock    *sync.Mutex
+	tracks        []*localStreamTrack
+	tracksChanged chan struct{}
+
+	video *segmenterTrack
+	audio *segmenterTrack
+
+	// current access unit being assembled, and when its first packet
+	// arrived
+	auNALUs    [][]byte
+	auTS       uint32
+	auReceived time.Time
+	auValid    bool
+
+	// when the keyframe at the start of the timeline arrived. the audio
+	// timeline is aligned to it by arrival time, since RTP timestamps of
+	// different tracks have unrelated offsets
+	timelineStart time.Time
+
+	sps, pps    []byte
+	initialized bool
+	sequence    uint32
+	samples     map[uint32][]fmp4Sample
+}
+
+func newFMP4Segmenter(proxy *LocalStreamProxy, name string, handler fmp4SegmentHandler) *fmp4Segmenter {
+	s := &fmp4Segmenter{
+		logger:        proxy.logger.With("output", name),
+		handler:       handler,
+		input:         make(chan segmenterInput, segmenterQueueSize),
+		done:          make(chan struct{}),
+		tracksLock:    &sync.Mutex{},
+		tracksChanged: make(chan struct{}, 1),
+		samples:       map[uint32][]fmp4Sample{},
+	}
+	go s.run()
+	return s
+}
+
+// setTracks never blocks, since it is called with the proxy's media lock
+// held.
+func (s *fmp4Segmenter) setTracks(tracks []*localStreamTrack) {
+	s.tracksLock.Lock()
+	s.tracks = tracks
+	s.tracksLock.Unlock()
+
+	select {
+	case s.tracksChanged <- struct{}{}:
+	default:
+		// already pending
+	}
+}
+
+// resetIfTracksChanged applies the tracks from the last setTracks call,
+// if there was one since the last reset.
+func (s *fmp4Segmenter) resetIfTracksChanged() {
+	select {
+	case <-s.tracksChanged:
+	default:
+		return
+	}
+	s.tracksLock.Lock()
+	tracks := s.tracks
+	s.tracksLock.Unlock()
+	s.reset(tracks)
+}
+
+func (s *fmp4Segmenter) writePacket(track *localStreamTrack, isRTCP bool, payload []byte) {
+	if isRTCP {
+		return
+	}
+	packet := make([]byte, len(payload))
+	copy(packet, payload)
+
+	select {
+	case s.input <- segmenterInput{track: track, payload: packet, received: time.Now()}:
+	default:
+		s.dropped++
+		if s.dropped%100 == 1 {
+			s.logger.Warn("Dropped %d packets, segmenter is falling behind", s.dropped)
+		}
+	}
+}
+
+func (s *fmp4Segmenter) close() {
+	close(s.input)
+	<-s.done
+}
+
+func (s *fmp4Segmenter) run() {
+	defer close(s.done)
+	defer s.handler.close()
+
+	for in := range s.input {
+		// packets for new tracks are only written after setTracks, so
+		// checking here keeps them from being processed before the reset
+		s.resetIfTracksChanged()
+
+		packet := &rtp.Packet{}
+		if err := packet.Unmarshal(in.payload); err != nil {
+			s.logger.Debug("Could not parse rtp: %s", err)
+			continue
+		}
+		switch {
+		case s.video != nil && s.video.source == in.track:
+			s.handleVideo(packet, in.received)
+		case s.audio != nil && s.audio.source == in.track:
+			s.handleAudio(packet, in.received)
+		}
+	}
+
+	if s.initialized {
+		s.flush()
+	}
+}
+
+// reset discards all state and starts over with a new set of tracks,
+// e.g. when a different proxy session starts publishing.
+func (s *fmp4Segmenter) reset(tracks []*localStreamTrack) {
+	s.video, s.audio = nil, nil
+	s.auNALUs, s.auValid = nil, false
+	s.sps, s.pps = nil, nil
+	s.initialized = false
+	s.samples = map[uint32][]fmp4Sample{}
+
+	for _, track := range tracks {
+		switch {
+		case track.kind == "video" && strings.EqualFold(track.codec, "H264") && s.video == nil:
+			if track.clockRate == 0 {
+				s.logger.Info("Ignoring video track without a clock rate")
+				continue
+			}
+			s.video = &segmenterTrack{
+				source: track,
+				h264:   &h264Depacketizer{},
+				fmp4: &fmp4Track{
+					id:        fmp4VideoTrackID,
+					kind:      fmp4Video,
+					timescale: track.clockRate,
+				},
+			}
+			s.sps, s.pps = h264ParameterSetsFromFmtp(track.fmtpParam("sprop-parameter-sets"))
+
+		case track.kind == "audio" && strings.EqualFold(track.codec, "MPEG4-GENERIC") && s.audio == nil:
+			config, err := parseAACConfig(track.fmtpParam("config"))
+			if err != nil {
+				s.logger.Info("Ignoring audio track: %s", err)
+				continue
+			}
+			depacketizer, err := newAACDepacketizer(track)
+			if err != nil {
+				s.logger.Info("Ignoring audio track: %s", err)
+				continue
+			}
+			s.audio = &segmenterTrack{
+				source: track,
+				aac:    depacketizer,
+				fmp4: &fmp4Track{
+					id:        fmp4AudioTrackID,
+					kind:      fmp4Audio,
+					timescale: uint32(config.sampleRate),
+					aac:       config,
+				},
+			}
+		}
+	}
+
+	if s.video == nil {
+		s.logger.Info("Stream has no H.264 video track, nothing will be written")
+	}
+}
+
+func (s *fmp4Segmenter) handleVideo(packet *rtp.Packet, received time.Time) {
+	if s.auValid && packet.Timestamp != s.auTS {
+		// the marker bit of the previous access unit was lost
+		s.finishAccessUnit()
+	}
+
+	nalus, err := s.video.h264.depacketize(packet.Payload)
+	if err != nil {
+		s.logger.Debug("%s", err)
+		s.video.h264.reset()
+		return
+	}
+	if !s.auValid {
+		s.auReceived = received
+	}
+	s.auNALUs = append(s.auNALUs, nalus...)
+	s.auTS = packet.Timestamp
+	s.auValid = true
+
+	if packet.Marker {
+		s.finishAccessUnit()
+	}
+}
+
+func (s *fmp4Segmenter) finishAccessUnit() {
+	nalus, ts, received := s.auNALUs, s.auTS, s.auReceived
+	s.auNALUs, s.auValid = nil, false
+
+	keyframe := false
+	data := []byte{}
+	for _, nalu := range nalus {
+		switch h264NALUType(nalu) {
+		case h264NALUTypeAUD:
+			continue
+		case h264NALUTypeSPS:
+			if !bytes.Equal(nalu, s.sps) {
+				s.sps = nalu
+				if s.initialized {
+					s.logger.Info("Sps changed, starting new init segment")
+					s.flush()
+					s.initialized = false
+				}
+			}
+		case h264NALUTypePPS:
+			if !bytes.Equal(nalu, s.pps) {
+				s.pps = nalu
+				if s.initialized {
+					s.flush()
+					s.initialized = false
+				}
+			}
+		case h264NALUTypeIDR:
+			keyframe = true
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(len(nalu)))
+		data = append(data, nalu...)
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	if !s.initialized {
+		if !keyframe || s.sps == nil || s.pps == nil {
+			return
+		}
+		if !s.writeInit(ts, received) {
+			return
+		}
+	}
+
+	dts, ok := s.video.dts(ts)
+	if !ok {
+		return
+	}
+	videoSamples := s.samples[fmp4VideoTrackID]
+	if n := len(videoSamples); n > 0 {
+		last := &videoSamples[n-1]
+		if dts > last.dts {
+			last.duration = uint32(dts - last.dts)
+		}
+	}
+	if keyframe && len(videoSamples) > 0 {
+		s.flush()
+	}
+
+	s.samples[fmp4VideoTrackID] = append(s.samples[fmp4VideoTrackID], fmp4Sample{
+		dts:      dts,
+		data:     data,
+		keyframe: keyframe,
+	})
+}
+
+// writeInit emits an init segment for the current parameter sets, and
+// restarts the timelines so that this keyframe is at time zero.
+func (s *fmp4Segmenter) writeInit(ts uint32, received time.Time) bool {
+	width, height, err := h264SPSDimensions(s.sps)
+	if err != nil {
+		s.logger.Info("Could not parse sps: %s", err)
+		return false
+	}
+	s.video.fmp4.sps = s.sps
+	s.video.fmp4.pps = s.pps
+	s.video.fmp4.width = width
+	s.video.fmp4.height = height
+
+	s.video.started, s.video.wraps = false, 0
+	s.video.base = s.video.unwrap(ts)
+	s.timelineStart = received
+	if s.audio != nil {
+		s.audio.started, s.audio.wraps = false, 0
+	}
+
+	s.handler.onInit(fmp4InitSegment(s.fmp4Tracks()))
+	s.initialized = true
+	s.logger.Debug("Wrote init segment for %dx%d video", width, height)
+	return true
+}
+
+func (s *fmp4Segmenter) fmp4Tracks() []*fmp4Track {
+	tracks := []*fmp4Track{s.video.fmp4}
+	if s.audio != nil {
+		tracks = append(tracks, s.audio.fmp4)
+	}
+	return tracks
+}
+
+func (s *fmp4Segmenter) handleAudio(packet *rtp.Packet, received time.Time) {
+	if !s.initialized {
+		return
+	}
+
+	units, err := s.audio.aac.depacketize(packet.Payload)
+	if err != nil {
+		s.logger.Debug("%s", err)
+		return
+	}
+
+	if !s.audio.started {
+		// place the first packet at its arrival time in the video's
+		// timeline
+		s.audio.base = s.audio.unwrap(packet.Timestamp)
+		s.audio.start = 0
+		if offset := received.Sub(s.timelineStart); offset > 0 {
+			s.audio.start = uint64(offset) * uint64(s.audio.fmp4.timescale) / uint64(time.Second)
+		}
+	}
+	dts, ok := s.audio.dts(packet.Timestamp)
+	if !ok {
+		return
+	}
+	for i, unit := range units {
+		s.samples[fmp4AudioTrackID] = append(s.samples[fmp4AudioTrackID], fmp4Sample{
+			dts:      dts + uint64(i*aacSamplesPerFrame),
+			duration: aacSamplesPerFrame,
+			data:     unit,
+			keyframe: true,
+		})
+	}
+}
+
+// flush writes out all pending samples as a fragment.
+func (s *fmp4Segmenter) flush() {
+	videoSamples := s.samples[fmp4VideoTrackID]
+	if len(videoSamples) == 0 {
+		return
+	}
+
+	// the duration of the final frame isn't known until the next one
+	// arrives, so assume it matches the previous one
+	if n := len(videoSamples); n > 1 && videoSamples[n-1].duration == 0 {
+		videoSamples[n-1].duration = videoSamples[n-2].duration
+	}
+
+	var total uint64
+	for _, sample := range videoSamples {
+		total += uint64(sample.duration)
+	}
+	duration := time.Duration(total) * time.Second / time.Duration(s.video.fmp4.timescale)
+
+	s.sequence++
+	s.handler.onFragment(fmp4Fragment(s.sequence, s.fmp4Tracks(), s.samples), duration)
+	s.samples = map[uint32][]fmp4Sample{}
+}
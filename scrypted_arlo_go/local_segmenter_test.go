@@ -0,0 +1,83 @@
+package scrypted_arlo_go
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSegmenterTrackUnwrap(t *testing.T) {
+	tests := []struct {
+		name       string
+		timestamps []uint32
+		want       []uint64
+	}{
+		{
+			name:       "no wrap",
+			timestamps: []uint32{1000, 4000, 7000},
+			want:       []uint64{1000, 4000, 7000},
+		},
+		{
+			name:       "reordered",
+			timestamps: []uint32{7000, 4000, 10000},
+			want:       []uint64{7000, 4000, 10000},
+		},
+		{
+			name:       "wrap",
+			timestamps: []uint32{0xfffff000, 0xfffffc00, 0x00000800, 0x00001400},
+			want:       []uint64{0xfffff000, 0xfffffc00, 0x100000800, 0x100001400},
+		},
+		{
+			name:       "reordered after wrap",
+			timestamps: []uint32{0xfffffc00, 0x00000800, 0x00000400, 0x00001400},
+			want:       []uint64{0xfffffc00, 0x100000800, 0x100000400, 0x100001400},
+		},
+		{
+			name:       "late packet from before a wrap",
+			timestamps: []uint32{0xfffffc00, 0x00000800, 0xfffffe00, 0x00001400},
+			want:       []uint64{0xfffffc00, 0x100000800, 0xfffffe00, 0x100001400},
+		},
+		{
+			name:       "two wraps",
+			timestamps: []uint32{0xf0000000, 0x10000000, 0x80000000, 0xf0000000, 0x10000000},
+			want:       []uint64{0xf0000000, 0x110000000, 0x180000000, 0x1f0000000, 0x210000000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			track := &segmenterTrack{}
+			got := []uint64{}
+			for _, ts := range tt.timestamps {
+				got = append(got, track.unwrap(ts))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unwrap() = %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSegmenterTrackDTS(t *testing.T) {
+	// the first packet arrived 1500 samples after the timeline started
+	track := &segmenterTrack{start: 1500}
+	track.base = track.unwrap(0xfffffc00)
+
+	tests := []struct {
+		ts     uint32
+		want   uint64
+		wantOK bool
+	}{
+		{ts: 0xfffffc00, want: 1500, wantOK: true},
+		{ts: 0x00000000, want: 2524, wantOK: true},
+		{ts: 0x00000400, want: 3548, wantOK: true},
+		{ts: 0xfffff800, wantOK: false},
+		{ts: 0xfffffe00, want: 2012, wantOK: true},
+		{ts: 0x00000800, want: 4572, wantOK: true},
+	}
+	for _, tt := range tests {
+		got, ok := track.dts(tt.ts)
+		if ok != tt.wantOK || ok && got != tt.want {
+			t.Errorf("dts(%x) = %d, %v, want %d, %v", tt.ts, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
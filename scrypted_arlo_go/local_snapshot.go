@@ -0,0 +1,128 @@
+package scrypted_arlo_go
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// keyframeGrabber assembles H.264 access units until it sees an IDR frame.
+type keyframeGrabber struct {
+	depacketizer *h264Depacketizer
+	sps, pps     []byte
+
+	nalus   [][]byte
+	auTS    uint32
+	auValid bool
+
+	keyframe []byte
+}
+
+func newKeyframeGrabber(track *localStreamTrack) *keyframeGrabber {
+	g := &keyframeGrabber{depacketizer: &h264Depacketizer{}}
+	g.sps, g.pps = h264ParameterSetsFromFmtp(track.fmtpParam("sprop-parameter-sets"))
+	return g
+}
+
+// writePacket returns true once a keyframe is available.
+func (g *keyframeGrabber) writePacket(payload []byte) bool {
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(payload); err != nil {
+		return false
+	}
+
+	if g.auValid && packet.Timestamp != g.auTS && g.finishAccessUnit() {
+		return true
+	}
+
+	nalus, err := g.depacketizer.depacketize(packet.Payload)
+	if err != nil {
+		g.depacketizer.reset()
+		return false
+	}
+	g.nalus = append(g.nalus, nalus...)
+	g.auTS = packet.Timestamp
+	g.auValid = true
+
+	return packet.Marker && g.finishAccessUnit()
+}
+
+func (g *keyframeGrabber) finishAccessUnit() bool {
+	nalus := g.nalus
+	g.nalus, g.auValid = nil, false
+
+	frame := [][]byte{}
+	keyframe := false
+	for _, nalu := range nalus {
+		switch h264NALUType(nalu) {
+		case h264NALUTypeSPS:
+			g.sps = nalu
+		case h264NALUTypePPS:
+			g.pps = nalu
+		case h264NALUTypeAUD:
+		case h264NALUTypeIDR:
+			keyframe = true
+			frame = append(frame, nalu)
+		default:
+			frame = append(frame, nalu)
+		}
+	}
+
+	if !keyframe || g.sps == nil || g.pps == nil {
+		return false
+	}
+	g.keyframe = h264AnnexB(append([][]byte{g.sps, g.pps}, frame...)...)
+	return true
+}
+
+// GrabKeyframe pulls the stream at streamPath from the basestation just
+// long enough to receive one H.264 IDR frame, and returns it as Annex-B
+// with the SPS and PPS in front, ready to be handed to a decoder.
+func (l *LocalStreamProxy) GrabKeyframe(streamPath string, timeout Duration) ([]byte, error) {
+	client, err := l.newLocalStreamClient("snapshot", streamPath)
+	if err != nil {
+		return nil, err
+	}
+	defer client.close()
+
+	// bounds the whole exchange, including the RTSP handshake
+	client.conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := client.play("video"); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, fmt.Errorf("timed out waiting for basestation after %s", timeout)
+		}
+		return nil, err
+	}
+
+	var grabber *keyframeGrabber
+	for _, track := range client.tracks {
+		if strings.EqualFold(track.codec, "H264") {
+			grabber = newKeyframeGrabber(track)
+			break
+		}
+	}
+	if grabber == nil {
+		return nil, fmt.Errorf("stream has no H.264 video track")
+	}
+
+	err = client.readMedia(func(track *localStreamTrack, isRTCP bool, payload []byte) {
+		if !isRTCP && grabber.keyframe == nil && grabber.writePacket(payload) {
+			client.close()
+		}
+	})
+	if grabber.keyframe != nil {
+		return grabber.keyframe, nil
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("timed out waiting for keyframe after %s", timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("stream ended before a keyframe was received")
+}
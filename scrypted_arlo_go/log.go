@@ -0,0 +1,269 @@
+package scrypted_arlo_go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LogLevelTrace = iota
+	LogLevelDebug
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+var logLevelNames = []string{"trace", "debug", "info", "warn", "error"}
+
+// well-known field keys
+const (
+	LogFieldComponent = "component"
+	LogFieldSession   = "session"
+	LogFieldDevice    = "device"
+)
+
+type logField struct {
+	key   string
+	value string
+}
+
+// logSink is the output shared by a Logger and everything derived from it.
+// Info and above go to the info writer, debug and trace to the debug writer.
+type logSink struct {
+	info  io.Writer
+	debug io.Writer
+
+	level atomic.Int32
+	json  atomic.Bool
+
+	closeOnce *sync.Once
+	closers   []func()
+}
+
+// Logger writes leveled log lines carrying key-value fields such as the
+// component, session and device they belong to. Lines are plain text by
+// default, or one JSON object per line with SetJSON.
+type Logger struct {
+	sink   *logSink
+	parent *Logger
+
+	// protects fields
+	lock   *sync.Mutex
+	fields []logField
+}
+
+func newLogger(info, debug io.Writer, closers ...func()) *Logger {
+	sink := &logSink{
+		info:      info,
+		debug:     debug,
+		closeOnce: &sync.Once{},
+		closers:   closers,
+	}
+	sink.level.Store(LogLevelDebug)
+	return &Logger{sink: sink, lock: &sync.Mutex{}}
+}
+
+// NewLogger creates a Logger sending info and above to the logging server
+// on infoLoggerPort and debug and trace to the one on debugLoggerPort.
+func NewLogger(infoLoggerPort, debugLoggerPort int, component string) (*Logger, error) {
+	infoLogger, err := NewTCPLogger(infoLoggerPort, component)
+	if err != nil {
+		return nil, err
+	}
+	debugLogger, err := NewTCPLogger(debugLoggerPort, component)
+	if err != nil {
+		infoLogger.Close()
+		return nil, err
+	}
+	l := newLogger(infoLogger, debugLogger, infoLogger.Close, debugLogger.Close)
+	l.SetField(LogFieldComponent, component)
+	return l, nil
+}
+
+// newStdoutLogger creates a Logger printing every level to stdout.
+func newStdoutLogger(component string) *Logger {
+	l := newLogger(os.Stdout, os.Stdout)
+	l.SetField(LogFieldComponent, component)
+	return l
+}
+
+// With returns a Logger sharing this one's output and settings, with an
+// additional field. Fields set later on this Logger also appear on the
+// derived one.
+func (l *Logger) With(key, value string) *Logger {
+	return &Logger{
+		sink:   l.sink,
+		parent: l,
+		lock:   &sync.Mutex{},
+		fields: []logField{{key, value}},
+	}
+}
+
+// SetField adds or replaces a field on every line from this Logger and
+// Loggers derived from it, e.g. SetField("device", deviceID).
+func (l *Logger) SetField(key, value string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := range l.fields {
+		if l.fields[i].key == key {
+			l.fields[i].value = value
+			return
+		}
+	}
+	l.fields = append(l.fields, logField{key, value})
+}
+
+// allFields returns the fields of this Logger and its parents, outermost
+// first, with inner values overriding outer ones.
+func (l *Logger) allFields() []logField {
+	var fields []logField
+	if l.parent != nil {
+		fields = l.parent.allFields()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+outer:
+	for _, f := range l.fields {
+		for i := range fields {
+			if fields[i].key == f.key {
+				fields[i].value = f.value
+				continue outer
+			}
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// SetLevel sets the minimum level logged, one of "trace", "debug",
+// "info", "warn" or "error". It applies to every Logger sharing the output.
+func (l *Logger) SetLevel(level string) error {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(level, name) {
+			l.sink.level.Store(int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level %q", level)
+}
+
+// GetLevel returns the name of the minimum level logged.
+func (l *Logger) GetLevel() string {
+	return logLevelNames[l.sink.level.Load()]
+}
+
+// SetJSON switches between plain text and JSON lines. It applies to every
+// Logger sharing the output.
+func (l *Logger) SetJSON(enabled bool) {
+	l.sink.json.Store(enabled)
+}
+
+func (l *Logger) enabled(level int) bool {
+	return int32(level) >= l.sink.level.Load()
+}
+
+func (l *Logger) log(level int, msg string, args ...any) {
+	if !l.enabled(level) {
+		return
+	}
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+
+	var line bytes.Buffer
+	fields := l.allFields()
+	if l.sink.json.Load() {
+		line.WriteString(`{"time":`)
+		writeJSONString(&line, time.Now().Format(time.RFC3339Nano))
+		line.WriteString(`,"level":`)
+		writeJSONString(&line, logLevelNames[level])
+		for _, f := range fields {
+			line.WriteByte(',')
+			writeJSONString(&line, f.key)
+			line.WriteByte(':')
+			writeJSONString(&line, f.value)
+		}
+		line.WriteString(`,"msg":`)
+		writeJSONString(&line, msg)
+		line.WriteString("}\n")
+	} else {
+		line.WriteString(strings.ToUpper(logLevelNames[level]))
+		line.WriteString(" [")
+		for i, f := range fields {
+			if i > 0 {
+				line.WriteByte(' ')
+			}
+			if f.key == LogFieldComponent {
+				line.WriteString(f.value)
+			} else {
+				fmt.Fprintf(&line, "%s=%s", f.key, f.value)
+			}
+		}
+		line.WriteString("] ")
+		line.WriteString(msg)
+		line.WriteByte('\n')
+	}
+
+	w := l.sink.info
+	if level < LogLevelInfo {
+		w = l.sink.debug
+	}
+	w.Write(line.Bytes())
+}
+
+func writeJSONString(b *bytes.Buffer, s string) {
+	encoded, _ := json.Marshal(s)
+	b.Write(encoded)
+}
+
+func (l *Logger) Trace(msg string, args ...any) {
+	l.log(LogLevelTrace, msg, args...)
+}
+
+func (l *Logger) Debug(msg string, args ...any) {
+	l.log(LogLevelDebug, msg, args...)
+}
+
+func (l *Logger) Info(msg string, args ...any) {
+	l.log(LogLevelInfo, msg, args...)
+}
+
+func (l *Logger) Warn(msg string, args ...any) {
+	l.log(LogLevelWarn, msg, args...)
+}
+
+func (l *Logger) Error(msg string, args ...any) {
+	l.log(LogLevelError, msg, args...)
+}
+
+// debugWriter adapts the Logger for libraries that write preformatted
+// lines to an io.Writer, logging each line at debug level.
+type debugWriter struct {
+	logger *Logger
+}
+
+func (w debugWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.Debug("%s", line)
+	}
+	return len(p), nil
+}
+
+// Close disconnects from the logging servers. Loggers sharing the output
+// fall back to stderr afterwards.
+func (l *Logger) Close() {
+	l.sink.closeOnce.Do(func() {
+		for _, c := range l.sink.closers {
+			c()
+		}
+	})
+}
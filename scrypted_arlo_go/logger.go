@@ -3,19 +3,62 @@ package scrypted_arlo_go
 import (
 	"fmt"
 	"net"
+	"os"
+	"sync"
+	"time"
 )
 
+const (
+	tcpLoggerQueueSize      = 1024
+	tcpLoggerWriteTimeout   = 5 * time.Second
+	tcpLoggerBackoffInitial = 1 * time.Second
+	tcpLoggerBackoffMax     = 30 * time.Second
+)
+
+// TCPLogger sends log lines to a Scrypted logging server. Lines are queued
+// and written by a background goroutine, so a slow or restarting server
+// never blocks the caller. While the server is unreachable, lines go to
+// stderr and the connection is retried with backoff.
 type TCPLogger struct {
-	conn net.Conn
+	address string
+	name    string
+
+	queue chan []byte
+
+	// protects dropped
+	lock    *sync.Mutex
+	dropped int
+
+	closeOnce *sync.Once
+	closed    chan struct{}
+	done      chan struct{}
 }
 
+// NewTCPLogger connects to the logging server on loggerPort. If the server
+// can't be reached yet, lines go to stderr until a retry succeeds, so the
+// returned error is always nil.
 func NewTCPLogger(loggerPort int, name string) (*TCPLogger, error) {
-	logger, err := net.Dial("tcp4", fmt.Sprintf("localhost:%d", loggerPort))
+	address := fmt.Sprintf("localhost:%d", loggerPort)
+	t := &TCPLogger{
+		address:   address,
+		name:      name,
+		queue:     make(chan []byte, tcpLoggerQueueSize),
+		lock:      &sync.Mutex{},
+		closeOnce: &sync.Once{},
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	conn, err := net.DialTimeout("tcp4", address, tcpLoggerWriteTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("could not connect to logger server: %w", err)
+		fmt.Fprintf(os.Stderr, "[%s]: could not connect to logging server %s, retrying in the background: %v\n",
+			name, address, err)
+		conn = nil
+	}
+	go t.run(conn)
+	if conn != nil {
+		t.Send(fmt.Sprintf("%s connected to logging server %s\n", name, address))
 	}
-	t := &TCPLogger{conn: logger}
-	t.Send(fmt.Sprintf("%s connected to logging server localhost:%d\n", name, loggerPort))
 	return t, nil
 }
 
@@ -23,10 +66,109 @@ func (t *TCPLogger) Send(s string) {
 	t.Write([]byte(s))
 }
 
+// Write queues p for the logging server. It never blocks; if the queue is
+// full the line is dropped and counted.
 func (t *TCPLogger) Write(p []byte) (n int, err error) {
-	return t.conn.Write(p)
+	select {
+	case <-t.closed:
+		return os.Stderr.Write(p)
+	default:
+	}
+
+	line := make([]byte, len(p))
+	copy(line, p)
+	select {
+	case t.queue <- line:
+	default:
+		t.lock.Lock()
+		t.dropped++
+		t.lock.Unlock()
+	}
+	return len(p), nil
+}
+
+// GetDroppedCount returns how many lines were dropped because the queue
+// was full.
+func (t *TCPLogger) GetDroppedCount() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.dropped
+}
+
+func (t *TCPLogger) fallback(line []byte) {
+	fmt.Fprintf(os.Stderr, "[%s]: %s", t.name, line)
+}
+
+// run owns the connection, writing queued lines and reconnecting after
+// failures, or connecting for the first time if conn is nil. On close,
+// lines still queued are flushed before returning.
+func (t *TCPLogger) run(conn net.Conn) {
+	defer close(t.done)
+
+	failures := 0
+	var retry <-chan time.Time
+	if conn == nil {
+		retry = time.After(jitteredBackoff(tcpLoggerBackoffInitial, tcpLoggerBackoffMax, failures))
+		failures++
+	}
+
+	write := func(line []byte) {
+		if conn == nil {
+			t.fallback(line)
+			return
+		}
+		conn.SetWriteDeadline(time.Now().Add(tcpLoggerWriteTimeout))
+		if _, err := conn.Write(line); err != nil {
+			conn.Close()
+			conn = nil
+			delay := jitteredBackoff(tcpLoggerBackoffInitial, tcpLoggerBackoffMax, failures)
+			failures++
+			retry = time.After(delay)
+			fmt.Fprintf(os.Stderr, "[%s]: lost connection to logging server %s, retrying in %s: %v\n",
+				t.name, t.address, delay.Round(time.Millisecond), err)
+			t.fallback(line)
+		}
+	}
+
+	for {
+		select {
+		case line := <-t.queue:
+			write(line)
+
+		case <-retry:
+			retry = nil
+			c, err := net.DialTimeout("tcp4", t.address, tcpLoggerWriteTimeout)
+			if err != nil {
+				retry = time.After(jitteredBackoff(tcpLoggerBackoffInitial, tcpLoggerBackoffMax, failures))
+				failures++
+				continue
+			}
+			conn = c
+			failures = 0
+			write([]byte(fmt.Sprintf("%s connected to logging server %s (%d lines dropped so far)\n",
+				t.name, t.address, t.GetDroppedCount())))
+
+		case <-t.closed:
+			for {
+				select {
+				case line := <-t.queue:
+					write(line)
+				default:
+					if conn != nil {
+						conn.Close()
+					}
+					return
+				}
+			}
+		}
+	}
 }
 
+// Close flushes queued lines and disconnects from the logging server.
+// Lines written afterwards go to stderr.
 func (t *TCPLogger) Close() {
-	t.conn.Close()
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+	<-t.done
 }
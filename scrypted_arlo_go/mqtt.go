@@ -0,0 +1,529 @@
+package scrypted_arlo_go
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	mqttDefaultKeepAlive  = 30 * time.Second
+	mqttAckTimeout        = 10 * time.Second
+	mqttMessageBufferSize = 64
+)
+
+var errMQTTNotConnected = errors.New("mqtt client is not connected")
+
+type MQTTInfo struct {
+	// websocket information
+	WebsocketURI     string
+	WebsocketHeaders HeadersMap
+	WebsocketOrigin  string
+
+	// credentials sent in CONNECT. a random client ID is used if empty
+	ClientID string
+	Username string
+	Password string
+
+	// by default the broker keeps the session for ClientID across
+	// reconnects, so that QoS 1 messages published while disconnected
+	// are delivered once the client is back. set to start afresh on
+	// every connection, in which case QoS 1 only holds within one
+	CleanSession bool
+
+	// interval between pings, defaults to 30 seconds
+	KeepAlive Duration
+}
+
+// MQTTClient receives events published over MQTT on a WebSocket, and
+// reconnects and resubscribes whenever the connection is lost.
+type MQTTClient struct {
+	UUID string
+
+	info   MQTTInfo
+	logger *Logger
+
+	messages chan *MQTTMessage
+
+	// delay before the first reconnection attempt, doubling on every
+	// consecutive failure up to backoffMax
+	backoffInitial Duration
+	backoffMax     Duration
+
+	// topics and their QoS, subscribed again on every connection
+	subscriptions     map[string]byte
+	subscriptionsLock *sync.Mutex
+
+	// protects the connection, writes to it and in-flight acks
+	connLock     *sync.Mutex
+	conn         *websocket.Conn
+	nextPacketID uint16
+	pending      map[uint16]chan *mqttPacket
+
+	closeOnce *sync.Once
+	closed    chan struct{}
+
+	// closed once Start gives up, after which no more messages arrive
+	finished chan struct{}
+
+	// connection state reported to callers
+	stateLock  *sync.Mutex
+	reconnects int
+	lastError  error
+}
+
+func NewMQTTClient(info MQTTInfo) (*MQTTClient, error) {
+	if info.WebsocketURI == "" {
+		return nil, fmt.Errorf("no websocket uri provided")
+	}
+	if info.Password != "" && info.Username == "" {
+		return nil, fmt.Errorf("mqtt password provided without a username")
+	}
+	if info.ClientID == "" {
+		info.ClientID = "scrypted-arlo-go-" + uuid.New().String()
+	}
+	if info.KeepAlive <= 0 {
+		info.KeepAlive = mqttDefaultKeepAlive
+	}
+
+	m := &MQTTClient{
+		UUID:              uuid.New().String(),
+		info:              info,
+		logger:            newStdoutLogger("MQTTClient"),
+		messages:          make(chan *MQTTMessage, mqttMessageBufferSize),
+		backoffInitial:    sseDefaultBackoffInitial,
+		backoffMax:        sseDefaultBackoffMax,
+		subscriptions:     map[string]byte{},
+		subscriptionsLock: &sync.Mutex{},
+		connLock:          &sync.Mutex{},
+		pending:           map[uint16]chan *mqttPacket{},
+		closeOnce:         &sync.Once{},
+		closed:            make(chan struct{}),
+		finished:          make(chan struct{}),
+		stateLock:         &sync.Mutex{},
+	}
+	m.logger.SetField(LogFieldSession, m.UUID)
+	return m, nil
+}
+
+// SetLogger sends the client's logs to l instead of stdout. Must be called
+// before Start.
+func (m *MQTTClient) SetLogger(l *Logger) {
+	m.logger = l.With(LogFieldSession, m.UUID)
+}
+
+// GetLogger returns the client's logger, e.g. to set the device ID field,
+// the level or the output format.
+func (m *MQTTClient) GetLogger() *Logger {
+	return m.logger
+}
+
+// SetBackoff configures the delay between reconnection attempts, in the
+// same way as SSEClient.SetBackoff. Must be called before Start.
+func (m *MQTTClient) SetBackoff(initial, max Duration) {
+	if initial > 0 {
+		m.backoffInitial = initial
+	}
+	if max > 0 {
+		m.backoffMax = max
+	}
+}
+
+func (m *MQTTClient) write(p *mqttPacket) error {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	if m.conn == nil {
+		return errMQTTNotConnected
+	}
+	if _, err := m.conn.Write(p.encode()); err != nil {
+		return fmt.Errorf("could not write mqtt packet: %w", err)
+	}
+	return nil
+}
+
+// request sends a packet built with a fresh packet ID and waits for the
+// matching acknowledgement.
+func (m *MQTTClient) request(build func(packetID uint16) *mqttPacket) (*mqttPacket, error) {
+	m.connLock.Lock()
+	if m.conn == nil {
+		m.connLock.Unlock()
+		return nil, errMQTTNotConnected
+	}
+	m.nextPacketID++
+	if m.nextPacketID == 0 {
+		m.nextPacketID = 1
+	}
+	packetID := m.nextPacketID
+	ack := make(chan *mqttPacket, 1)
+	m.pending[packetID] = ack
+	_, err := m.conn.Write(build(packetID).encode())
+	m.connLock.Unlock()
+
+	defer func() {
+		m.connLock.Lock()
+		delete(m.pending, packetID)
+		m.connLock.Unlock()
+	}()
+
+	if err != nil {
+		return nil, fmt.Errorf("could not write mqtt packet: %w", err)
+	}
+
+	select {
+	case p, ok := <-ack:
+		if !ok {
+			return nil, errMQTTNotConnected
+		}
+		return p, nil
+	case <-time.After(mqttAckTimeout):
+		return nil, fmt.Errorf("timed out waiting for mqtt acknowledgement")
+	case <-m.closed:
+		return nil, errMQTTNotConnected
+	}
+}
+
+// Subscribe subscribes to topic with QoS 0 or 1. The subscription is
+// remembered and renewed on every reconnection. If the client is not
+// connected yet, it takes effect once it is.
+func (m *MQTTClient) Subscribe(topic string, qos int) error {
+	if qos != 0 && qos != 1 {
+		return fmt.Errorf("unsupported qos %d", qos)
+	}
+
+	m.subscriptionsLock.Lock()
+	m.subscriptions[topic] = byte(qos)
+	m.subscriptionsLock.Unlock()
+
+	ack, err := m.request(func(packetID uint16) *mqttPacket {
+		return newMQTTSubscribe(packetID, topic, byte(qos))
+	})
+	if errors.Is(err, errMQTTNotConnected) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not subscribe to %s: %w", topic, err)
+	}
+	if ack.subscriptionRefused() {
+		return fmt.Errorf("broker refused subscription to %s", topic)
+	}
+	return nil
+}
+
+// Unsubscribe removes a subscription made with Subscribe.
+func (m *MQTTClient) Unsubscribe(topic string) error {
+	m.subscriptionsLock.Lock()
+	delete(m.subscriptions, topic)
+	m.subscriptionsLock.Unlock()
+
+	_, err := m.request(func(packetID uint16) *mqttPacket {
+		return newMQTTUnsubscribe(packetID, topic)
+	})
+	if err != nil && !errors.Is(err, errMQTTNotConnected) {
+		return fmt.Errorf("could not unsubscribe from %s: %w", topic, err)
+	}
+	return nil
+}
+
+// Publish sends payload to topic. With QoS 1 it waits for the broker to
+// acknowledge the message.
+func (m *MQTTClient) Publish(topic, payload string, qos int) error {
+	switch qos {
+	case 0:
+		return m.write(newMQTTPublish(0, topic, []byte(payload), 0))
+	case 1:
+		_, err := m.request(func(packetID uint16) *mqttPacket {
+			return newMQTTPublish(packetID, topic, []byte(payload), 1)
+		})
+		return err
+	}
+	return fmt.Errorf("unsupported qos %d", qos)
+}
+
+// connect dials the broker and completes the CONNECT handshake.
+func (m *MQTTClient) connect() (*websocket.Conn, *bufio.Reader, error) {
+	cfg, err := websocket.NewConfig(m.info.WebsocketURI, m.info.WebsocketOrigin)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create websocket config: %w", err)
+	}
+	cfg.Header = m.info.WebsocketHeaders.toHTTPHeaders()
+	cfg.Protocol = []string{"mqtt"}
+
+	conn, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not dial websocket: %w", err)
+	}
+	conn.PayloadType = websocket.BinaryFrame
+
+	keepAlive := uint16(m.info.KeepAlive / time.Second)
+	connect := newMQTTConnect(m.info.ClientID, m.info.Username, m.info.Password, keepAlive, m.info.CleanSession)
+	if _, err := conn.Write(connect.encode()); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("could not send connect: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(mqttAckTimeout))
+	connack, err := readMQTTPacket(reader)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("could not read connack: %w", err)
+	}
+	if connack.packetType != mqttConnack || len(connack.body) < 2 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("expected connack, got packet type %d", connack.packetType)
+	}
+	if code := connack.body[1]; code != 0 {
+		conn.Close()
+		return nil, nil, fmt.Errorf("broker refused connection with code %d", code)
+	}
+	if !m.info.CleanSession && connack.body[0]&0x01 == 0 {
+		m.logger.Debug("Broker has no session for %s, starting a new one", m.info.ClientID)
+	}
+
+	return conn, reader, nil
+}
+
+// session runs a single connection until it fails, reporting whether the
+// handshake succeeded.
+func (m *MQTTClient) session() (bool, error) {
+	conn, reader, err := m.connect()
+	if err != nil {
+		return false, err
+	}
+
+	m.connLock.Lock()
+	select {
+	case <-m.closed:
+		m.connLock.Unlock()
+		conn.Close()
+		return true, nil
+	default:
+	}
+	m.conn = conn
+	// subscriptions made from now on are sent by Subscribe itself
+	m.subscriptionsLock.Lock()
+	subscriptions := make(map[string]byte, len(m.subscriptions))
+	for topic, qos := range m.subscriptions {
+		subscriptions[topic] = qos
+	}
+	m.subscriptionsLock.Unlock()
+	m.connLock.Unlock()
+	m.logger.Info("Connected")
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		m.connLock.Lock()
+		m.conn = nil
+		for id, ack := range m.pending {
+			close(ack)
+			delete(m.pending, id)
+		}
+		m.connLock.Unlock()
+		conn.Close()
+	}()
+
+	go m.keepAlive(done)
+	go m.resubscribe(conn, subscriptions)
+
+	for {
+		// the broker answers every ping, so silence for longer than
+		// the keepalive means the connection is dead
+		conn.SetReadDeadline(time.Now().Add(m.info.KeepAlive * 3 / 2))
+		p, err := readMQTTPacket(reader)
+		if err != nil {
+			return true, fmt.Errorf("could not read mqtt packet: %w", err)
+		}
+
+		switch p.packetType {
+		case mqttPublish:
+			msg, err := parseMQTTPublish(p)
+			if err != nil {
+				return true, err
+			}
+			select {
+			case m.messages <- msg:
+			case <-m.closed:
+				return true, nil
+			}
+			if msg.QoS == 1 {
+				if err := m.write(newMQTTPuback(msg.packetID)); err != nil {
+					return true, err
+				}
+			}
+
+		case mqttPuback, mqttSuback, mqttUnsuback:
+			packetID, err := p.packetID()
+			if err != nil {
+				return true, err
+			}
+			m.connLock.Lock()
+			ack, ok := m.pending[packetID]
+			m.connLock.Unlock()
+			if ok {
+				ack <- p
+			}
+
+		case mqttPingresp:
+		default:
+			m.logger.Debug("Ignoring packet type %d", p.packetType)
+		}
+	}
+}
+
+// resubscribe renews subscriptions on a new connection. It runs alongside
+// the session's read loop, which delivers the acknowledgements.
+func (m *MQTTClient) resubscribe(conn *websocket.Conn, subscriptions map[string]byte) {
+	for topic, qos := range subscriptions {
+		ack, err := m.request(func(packetID uint16) *mqttPacket {
+			return newMQTTSubscribe(packetID, topic, qos)
+		})
+		if errors.Is(err, errMQTTNotConnected) {
+			return
+		}
+		if err != nil {
+			// a connection missing its subscriptions would silently
+			// miss events, so start over
+			m.logger.Warn("Could not resubscribe to %s, reconnecting: %v", topic, err)
+			conn.Close()
+			return
+		}
+		if ack.subscriptionRefused() {
+			m.logger.Warn("Broker refused subscription to %s", topic)
+		}
+	}
+}
+
+func (m *MQTTClient) keepAlive(done chan struct{}) {
+	ticker := time.NewTicker(m.info.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := m.write(&mqttPacket{packetType: mqttPingreq}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (m *MQTTClient) Start() {
+	go func() {
+		defer close(m.finished)
+
+		m.logger.Info("Starting")
+		failures := 0
+		for {
+			connected, err := m.session()
+
+			select {
+			case <-m.closed:
+				m.logger.Info("Exited")
+				return
+			default:
+			}
+
+			if connected {
+				failures = 0
+			}
+			if err == nil {
+				err = io.EOF
+			}
+			m.stateLock.Lock()
+			m.lastError = err
+			m.reconnects++
+			m.stateLock.Unlock()
+
+			delay := jitteredBackoff(m.backoffInitial, m.backoffMax, failures)
+			failures++
+			m.logger.Warn("Restarting in %s due to: %v", delay.Round(time.Millisecond), err)
+
+			select {
+			case <-m.closed:
+				m.logger.Info("Exited")
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+}
+
+// NextMessage blocks until a message arrives on a subscribed topic.
+func (m *MQTTClient) NextMessage() (*MQTTMessage, error) {
+	// prefer buffered messages, so that nothing is lost when the client
+	// finishes
+	select {
+	case msg := <-m.messages:
+		return msg, nil
+	default:
+	}
+
+	select {
+	case msg := <-m.messages:
+		return msg, nil
+	case <-m.finished:
+		select {
+		case msg := <-m.messages:
+			return msg, nil
+		default:
+			return nil, io.EOF
+		}
+	}
+}
+
+// Next blocks until a message arrives and returns its payload.
+func (m *MQTTClient) Next() (string, error) {
+	msg, err := m.NextMessage()
+	if err != nil {
+		return "", err
+	}
+	return msg.Payload, nil
+}
+
+// IsConnected reports whether the client currently has a connection.
+func (m *MQTTClient) IsConnected() bool {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+	return m.conn != nil
+}
+
+// GetReconnectCount returns how many times the connection has been lost
+// or failed and reattempted.
+func (m *MQTTClient) GetReconnectCount() int {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	return m.reconnects
+}
+
+// GetLastError returns the error that caused the most recent reconnection,
+// or an empty string if there hasn't been one.
+func (m *MQTTClient) GetLastError() string {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	if m.lastError == nil {
+		return ""
+	}
+	return m.lastError.Error()
+}
+
+func (m *MQTTClient) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+
+		m.connLock.Lock()
+		defer m.connLock.Unlock()
+		if m.conn != nil {
+			m.conn.Write((&mqttPacket{packetType: mqttDisconnect}).encode())
+			m.conn.Close()
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package scrypted_arlo_go
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// Arlo's events are at most a few kilobytes, so anything larger than this
+// is a corrupt stream rather than a packet worth allocating for
+const mqttMaxPacketSize = 1 << 20
+
+type mqttPacket struct {
+	packetType byte
+	flags      byte
+	body       []byte
+}
+
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length := 0
+	for i, multiplier := 0, 1; ; i, multiplier = i+1, multiplier*128 {
+		if i == 4 {
+			return nil, fmt.Errorf("malformed mqtt remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > mqttMaxPacketSize {
+		return nil, fmt.Errorf("mqtt packet of %d bytes exceeds maximum of %d", length, mqttMaxPacketSize)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &mqttPacket{packetType: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+func (p *mqttPacket) encode() []byte {
+	out := []byte{p.packetType<<4 | p.flags}
+	length := len(p.body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(out, p.body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func readMQTTString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, fmt.Errorf("truncated mqtt string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, fmt.Errorf("truncated mqtt string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// newMQTTConnect builds a CONNECT packet. A password is only sent along
+// with a username, since MQTT 3.1.1 doesn't allow one without the other.
+func newMQTTConnect(clientID, username, password string, keepAlive uint16, cleanSession bool) *mqttPacket {
+	if username == "" {
+		password = ""
+	}
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+
+	flags := byte(0)
+	if cleanSession {
+		flags |= 0x02
+	}
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, keepAlive)
+
+	body = appendMQTTString(body, clientID)
+	if username != "" {
+		body = appendMQTTString(body, username)
+	}
+	if password != "" {
+		body = appendMQTTString(body, password)
+	}
+	return &mqttPacket{packetType: mqttConnect, body: body}
+}
+
+func newMQTTSubscribe(packetID uint16, topic string, qos byte) *mqttPacket {
+	body := binary.BigEndian.AppendUint16(nil, packetID)
+	body = appendMQTTString(body, topic)
+	body = append(body, qos)
+	return &mqttPacket{packetType: mqttSubscribe, flags: 0x02, body: body}
+}
+
+func newMQTTUnsubscribe(packetID uint16, topic string) *mqttPacket {
+	body := binary.BigEndian.AppendUint16(nil, packetID)
+	body = appendMQTTString(body, topic)
+	return &mqttPacket{packetType: mqttUnsubscribe, flags: 0x02, body: body}
+}
+
+func newMQTTPublish(packetID uint16, topic string, payload []byte, qos byte) *mqttPacket {
+	body := appendMQTTString(nil, topic)
+	if qos > 0 {
+		body = binary.BigEndian.AppendUint16(body, packetID)
+	}
+	body = append(body, payload...)
+	return &mqttPacket{packetType: mqttPublish, flags: qos << 1, body: body}
+}
+
+func newMQTTPuback(packetID uint16) *mqttPacket {
+	return &mqttPacket{packetType: mqttPuback, body: binary.BigEndian.AppendUint16(nil, packetID)}
+}
+
+// subscriptionRefused reports whether a SUBACK's return code is a
+// failure.
+func (p *mqttPacket) subscriptionRefused() bool {
+	return len(p.body) < 3 || p.body[2] == 0x80
+}
+
+// packetID returns the identifier at the start of an ack's body.
+func (p *mqttPacket) packetID() (uint16, error) {
+	if len(p.body) < 2 {
+		return 0, fmt.Errorf("truncated mqtt packet id")
+	}
+	return binary.BigEndian.Uint16(p.body), nil
+}
+
+// MQTTMessage is a message published to a subscribed topic.
+type MQTTMessage struct {
+	Topic    string
+	Payload  string
+	QoS      int
+	Retained bool
+
+	packetID uint16
+}
+
+func parseMQTTPublish(p *mqttPacket) (*MQTTMessage, error) {
+	topic, rest, err := readMQTTString(p.body)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &MQTTMessage{
+		Topic:    topic,
+		QoS:      int(p.flags>>1) & 0x03,
+		Retained: p.flags&0x01 != 0,
+	}
+	if msg.QoS > 0 {
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("truncated mqtt publish")
+		}
+		msg.packetID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	msg.Payload = string(rest)
+	return msg, nil
+}
@@ -0,0 +1,460 @@
+package scrypted_arlo_go
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const testMQTTTimeout = 5 * time.Second
+
+// testMQTTBroker stands in for Arlo's broker. Every connection is handed
+// to the test, which plays the broker's side of the conversation.
+type testMQTTBroker struct {
+	server *httptest.Server
+	conns  chan *testMQTTConn
+}
+
+type testMQTTConn struct {
+	t      *testing.T
+	conn   *websocket.Conn
+	reader *bufio.Reader
+	closed chan struct{}
+}
+
+func newTestMQTTBroker(t *testing.T) *testMQTTBroker {
+	b := &testMQTTBroker{conns: make(chan *testMQTTConn, 4)}
+	b.server = httptest.NewServer(websocket.Server{
+		Handshake: func(cfg *websocket.Config, req *http.Request) error {
+			cfg.Protocol = []string{"mqtt"}
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			conn.PayloadType = websocket.BinaryFrame
+			c := &testMQTTConn{
+				t:      t,
+				conn:   conn,
+				reader: bufio.NewReader(conn),
+				closed: make(chan struct{}),
+			}
+			b.conns <- c
+			// returning from the handler closes the connection
+			<-c.closed
+		},
+	})
+	t.Cleanup(b.server.Close)
+	return b
+}
+
+func (b *testMQTTBroker) info() MQTTInfo {
+	return MQTTInfo{
+		WebsocketURI:    "ws" + strings.TrimPrefix(b.server.URL, "http"),
+		WebsocketOrigin: b.server.URL,
+		ClientID:        "test-client",
+	}
+}
+
+// accept waits for the client to connect and completes the handshake.
+func (b *testMQTTBroker) accept(t *testing.T) *testMQTTConn {
+	t.Helper()
+	select {
+	case c := <-b.conns:
+		t.Cleanup(c.close)
+		c.expect(mqttConnect)
+		c.send(&mqttPacket{packetType: mqttConnack, body: []byte{0, 0}})
+		return c
+	case <-time.After(testMQTTTimeout):
+		t.Fatal("timed out waiting for the client to connect")
+		return nil
+	}
+}
+
+func (c *testMQTTConn) expect(packetType byte) *mqttPacket {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(testMQTTTimeout))
+	p, err := readMQTTPacket(c.reader)
+	if err != nil {
+		c.t.Fatalf("could not read packet type %d: %s", packetType, err)
+	}
+	if p.packetType != packetType {
+		c.t.Fatalf("got packet type %d, want %d", p.packetType, packetType)
+	}
+	return p
+}
+
+func (c *testMQTTConn) send(p *mqttPacket) {
+	c.t.Helper()
+	if _, err := c.conn.Write(p.encode()); err != nil {
+		c.t.Fatalf("could not send packet: %s", err)
+	}
+}
+
+// expectSubscribe reads a SUBSCRIBE for topic and acknowledges it with
+// returnCode, returning its packet ID.
+func (c *testMQTTConn) expectSubscribe(topic string, returnCode byte) uint16 {
+	c.t.Helper()
+	p := c.expect(mqttSubscribe)
+	if p.flags != 0x02 {
+		c.t.Errorf("subscribe flags = %x, want 2", p.flags)
+	}
+	packetID, err := p.packetID()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if packetID == 0 {
+		c.t.Error("subscribe has packet id 0")
+	}
+	got, rest, err := readMQTTString(p.body[2:])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if got != topic {
+		c.t.Errorf("subscribed to %q, want %q", got, topic)
+	}
+	if !bytes.Equal(rest, []byte{1}) {
+		c.t.Errorf("subscribe qos = %x, want 1", rest)
+	}
+
+	body := binary.BigEndian.AppendUint16(nil, packetID)
+	c.send(&mqttPacket{packetType: mqttSuback, body: append(body, returnCode)})
+	return packetID
+}
+
+func (c *testMQTTConn) close() {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+}
+
+func startTestMQTTClient(t *testing.T, info MQTTInfo) *MQTTClient {
+	t.Helper()
+	m, err := NewMQTTClient(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetBackoff(10*time.Millisecond, 10*time.Millisecond)
+	m.Start()
+	t.Cleanup(m.Close)
+	return m
+}
+
+func waitForMQTTConnected(t *testing.T, m *MQTTClient) {
+	t.Helper()
+	deadline := time.Now().Add(testMQTTTimeout)
+	for !m.IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the client to be connected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMQTTClientConnect(t *testing.T) {
+	b := newTestMQTTBroker(t)
+	info := b.info()
+	info.Username = "user"
+	info.Password = "secret"
+	info.KeepAlive = 45 * time.Second
+	m := startTestMQTTClient(t, info)
+
+	var c *testMQTTConn
+	select {
+	case c = <-b.conns:
+		t.Cleanup(c.close)
+	case <-time.After(testMQTTTimeout):
+		t.Fatal("timed out waiting for the client to connect")
+	}
+
+	connect := c.expect(mqttConnect)
+	protocol, rest, err := readMQTTString(connect.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if protocol != "MQTT" || rest[0] != 4 {
+		t.Errorf("protocol = %s level %d, want MQTT level 4", protocol, rest[0])
+	}
+	if flags := rest[1]; flags != 0xc0 {
+		t.Errorf("connect flags = %x, want c0", flags)
+	}
+	if keepAlive := binary.BigEndian.Uint16(rest[2:]); keepAlive != 45 {
+		t.Errorf("keepalive = %d, want 45", keepAlive)
+	}
+	payload := []string{}
+	for rest = rest[4:]; len(rest) > 0; {
+		var s string
+		if s, rest, err = readMQTTString(rest); err != nil {
+			t.Fatal(err)
+		}
+		payload = append(payload, s)
+	}
+	if want := []string{"test-client", "user", "secret"}; strings.Join(payload, ",") != strings.Join(want, ",") {
+		t.Errorf("connect payload = %q, want %q", payload, want)
+	}
+
+	if m.IsConnected() {
+		t.Error("client is connected before connack")
+	}
+	c.send(&mqttPacket{packetType: mqttConnack, body: []byte{0, 0}})
+	waitForMQTTConnected(t, m)
+}
+
+func TestMQTTClientConnectRefused(t *testing.T) {
+	b := newTestMQTTBroker(t)
+	m := startTestMQTTClient(t, b.info())
+
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-b.conns:
+			c.expect(mqttConnect)
+			// not authorized
+			c.send(&mqttPacket{packetType: mqttConnack, body: []byte{0, 5}})
+			c.close()
+		case <-time.After(testMQTTTimeout):
+			t.Fatal("timed out waiting for the client to retry")
+		}
+	}
+
+	if !strings.Contains(m.GetLastError(), "code 5") {
+		t.Errorf("last error = %q, want refusal with code 5", m.GetLastError())
+	}
+}
+
+func TestNewMQTTClientPasswordWithoutUsername(t *testing.T) {
+	if _, err := NewMQTTClient(MQTTInfo{WebsocketURI: "ws://localhost", Password: "secret"}); err == nil {
+		t.Error("NewMQTTClient() accepted a password without a username")
+	}
+}
+
+func TestMQTTClientSubscribe(t *testing.T) {
+	tests := []struct {
+		name       string
+		returnCode byte
+		wantErr    bool
+	}{
+		{name: "granted", returnCode: 1},
+		{name: "refused", returnCode: 0x80, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestMQTTBroker(t)
+			m := startTestMQTTClient(t, b.info())
+			c := b.accept(t)
+			waitForMQTTConnected(t, m)
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- m.Subscribe("events/test", 1)
+			}()
+			c.expectSubscribe("events/test", tt.returnCode)
+
+			select {
+			case err := <-errs:
+				if (err != nil) != tt.wantErr {
+					t.Errorf("Subscribe() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			case <-time.After(testMQTTTimeout):
+				t.Fatal("Subscribe() didn't return after suback")
+			}
+		})
+	}
+}
+
+func TestMQTTClientReceiveQoS1(t *testing.T) {
+	b := newTestMQTTBroker(t)
+	m := startTestMQTTClient(t, b.info())
+	c := b.accept(t)
+
+	c.send(newMQTTPublish(42, "events/test", []byte(`{"resource":"cameras/1"}`), 1))
+
+	msg, err := m.NextMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "events/test" || msg.Payload != `{"resource":"cameras/1"}` || msg.QoS != 1 {
+		t.Errorf("NextMessage() = %+v", msg)
+	}
+
+	puback := c.expect(mqttPuback)
+	if packetID, err := puback.packetID(); err != nil || packetID != 42 {
+		t.Errorf("puback packet id = %d (%v), want 42", packetID, err)
+	}
+}
+
+func TestMQTTClientPublishQoS1(t *testing.T) {
+	b := newTestMQTTBroker(t)
+	m := startTestMQTTClient(t, b.info())
+	c := b.accept(t)
+	waitForMQTTConnected(t, m)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- m.Publish("commands/test", "hello", 1)
+	}()
+
+	p := c.expect(mqttPublish)
+	msg, err := parseMQTTPublish(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Topic != "commands/test" || msg.Payload != "hello" || msg.QoS != 1 {
+		t.Errorf("broker received %+v", msg)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("Publish() returned %v before puback", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.send(newMQTTPuback(msg.packetID))
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("Publish() error = %v", err)
+		}
+	case <-time.After(testMQTTTimeout):
+		t.Fatal("Publish() didn't return after puback")
+	}
+}
+
+func TestMQTTClientPing(t *testing.T) {
+	b := newTestMQTTBroker(t)
+	info := b.info()
+	info.KeepAlive = 50 * time.Millisecond
+	m := startTestMQTTClient(t, info)
+	c := b.accept(t)
+
+	for i := 0; i < 3; i++ {
+		c.expect(mqttPingreq)
+		c.send(&mqttPacket{packetType: mqttPingresp})
+	}
+
+	if !m.IsConnected() || m.GetReconnectCount() != 0 {
+		t.Errorf("client reconnected while pings were answered: %s", m.GetLastError())
+	}
+}
+
+func TestMQTTClientResubscribe(t *testing.T) {
+	b := newTestMQTTBroker(t)
+	m := startTestMQTTClient(t, b.info())
+	c := b.accept(t)
+	waitForMQTTConnected(t, m)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- m.Subscribe("events/test", 1)
+	}()
+	firstID := c.expectSubscribe("events/test", 1)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	c.close()
+	c = b.accept(t)
+	secondID := c.expectSubscribe("events/test", 1)
+	if secondID == firstID {
+		t.Errorf("resubscribe reused packet id %d", secondID)
+	}
+
+	// the session carries on once the resubscription is acknowledged
+	c.send(newMQTTPublish(0, "events/test", []byte("after reconnect"), 0))
+	msg, err := m.NextMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Payload != "after reconnect" {
+		t.Errorf("NextMessage() = %q, want %q", msg.Payload, "after reconnect")
+	}
+	if count := m.GetReconnectCount(); count != 1 {
+		t.Errorf("GetReconnectCount() = %d, want 1", count)
+	}
+}
+
+func TestReadMQTTPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    *mqttPacket
+		wantErr bool
+	}{
+		{
+			name: "pingresp",
+			data: []byte{0xd0, 0x00},
+			want: &mqttPacket{packetType: mqttPingresp, body: []byte{}},
+		},
+		{
+			name: "two byte length",
+			data: append([]byte{0x32, 0x80, 0x01}, make([]byte, 128)...),
+			want: &mqttPacket{packetType: mqttPublish, flags: 0x02, body: make([]byte, 128)},
+		},
+		{
+			name:    "truncated body",
+			data:    []byte{0x30, 0x05, 0x00},
+			wantErr: true,
+		},
+		{
+			name:    "malformed length",
+			data:    []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01},
+			wantErr: true,
+		},
+		{
+			name:    "too large",
+			data:    []byte{0x30, 0xff, 0xff, 0xff, 0x7f},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(tt.data)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readMQTTPacket() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == nil {
+				return
+			}
+			if got.packetType != tt.want.packetType || got.flags != tt.want.flags || !bytes.Equal(got.body, tt.want.body) {
+				t.Errorf("readMQTTPacket() = %+v, want %+v", got, tt.want)
+			}
+			if !bytes.Equal(got.encode(), tt.data) {
+				t.Errorf("encode() = %x, want %x", got.encode(), tt.data)
+			}
+		})
+	}
+}
+
+func TestNewMQTTConnectPasswordWithoutUsername(t *testing.T) {
+	p := newMQTTConnect("client", "", "secret", 30, false)
+	_, rest, err := readMQTTString(p.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags := rest[1]; flags&0xc0 != 0 {
+		t.Errorf("connect flags = %x, want no username or password", flags)
+	}
+	if bytes.Contains(p.body, []byte("secret")) {
+		t.Error("connect contains the password")
+	}
+}
+
+func TestNewMQTTConnectCleanSession(t *testing.T) {
+	for _, cleanSession := range []bool{false, true} {
+		p := newMQTTConnect("client", "", "", 30, cleanSession)
+		_, rest, err := readMQTTString(p.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rest[1]&0x02 != 0; got != cleanSession {
+			t.Errorf("clean session flag = %v, want %v", got, cleanSession)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package scrypted_arlo_go
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// upper bounds on the size of RTSP headers and bodies, to avoid
+// buffering forever if the stream is corrupt
+const (
+	rtspMaxHeaderLen = 64 * 1024
+	rtspMaxBodyLen   = 1024 * 1024
+)
+
+// rtspMessage is a single unit read off an RTSP-over-TCP stream: either
+// a complete RTSP request or response including its body, or a
+// $-prefixed interleaved binary frame.
+type rtspMessage struct {
+	// the message exactly as it appeared on the wire
+	raw []byte
+
+	// set for interleaved frames
+	interleaved bool
+	channel     byte
+	payload     []byte
+}
+
+// rtspStreamReader splits a TCP stream into rtspMessages, regardless of
+// how the underlying reads happen to be segmented.
+type rtspStreamReader struct {
+	r *bufio.Reader
+}
+
+func newRTSPStreamReader(r io.Reader) *rtspStreamReader {
+	// a header line can't be longer than the buffer, see readText
+	return &rtspStreamReader{r: bufio.NewReaderSize(r, rtspMaxHeaderLen)}
+}
+
+func (r *rtspStreamReader) next() (*rtspMessage, error) {
+	for {
+		first, err := r.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		switch first[0] {
+		case '$':
+			return r.readInterleaved()
+		case '\r', '\n':
+			// tolerate stray line breaks between messages
+			r.r.ReadByte()
+			continue
+		}
+		return r.readText()
+	}
+}
+
+func (r *rtspStreamReader) readInterleaved() (*rtspMessage, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(header[2:])
+	raw := make([]byte, 4+int(length))
+	copy(raw, header)
+	if _, err := io.ReadFull(r.r, raw[4:]); err != nil {
+		return nil, err
+	}
+
+	return &rtspMessage{
+		raw:         raw,
+		interleaved: true,
+		channel:     header[1],
+		payload:     raw[4:],
+	}, nil
+}
+
+func (r *rtspStreamReader) readText() (*rtspMessage, error) {
+	var buf bytes.Buffer
+	contentLength := 0
+
+	for {
+		line, err := r.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return nil, fmt.Errorf("rtsp header line exceeds %d bytes", rtspMaxHeaderLen)
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+
+		if buf.Len() > rtspMaxHeaderLen {
+			return nil, fmt.Errorf("rtsp headers exceed %d bytes", rtspMaxHeaderLen)
+		}
+
+		trimmed := strings.TrimRight(string(line), "\r\n")
+		if trimmed == "" {
+			break
+		}
+
+		if k, v, ok := strings.Cut(trimmed, ":"); ok && strings.EqualFold(strings.TrimSpace(k), "Content-Length") {
+			contentLength, err = strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || contentLength < 0 {
+				return nil, fmt.Errorf("invalid Content-Length %q", v)
+			}
+			if contentLength > rtspMaxBodyLen {
+				return nil, fmt.Errorf("rtsp Content-Length %d exceeds %d bytes", contentLength, rtspMaxBodyLen)
+			}
+		}
+	}
+
+	if contentLength > 0 {
+		body := make([]byte, contentLength)
+		if _, err := io.ReadFull(r.r, body); err != nil {
+			return nil, err
+		}
+		buf.Write(body)
+	}
+
+	return &rtspMessage{raw: buf.Bytes()}, nil
+}
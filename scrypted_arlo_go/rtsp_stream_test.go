@@ -0,0 +1,60 @@
+package scrypted_arlo_go
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRTSPStreamReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "response with body",
+			stream: "RTSP/1.0 200 OK\r\nCSeq: 1\r\nContent-Length: 4\r\n\r\nv=0\n",
+			want:   []string{"RTSP/1.0 200 OK\r\nCSeq: 1\r\nContent-Length: 4\r\n\r\nv=0\n"},
+		},
+		{
+			name:   "interleaved frame between messages",
+			stream: "RTSP/1.0 200 OK\r\nCSeq: 1\r\n\r\n\r\n$\x01\x00\x02ab",
+			want:   []string{"RTSP/1.0 200 OK\r\nCSeq: 1\r\n\r\n", "$\x01\x00\x02ab"},
+		},
+		{
+			name:    "header line too long",
+			stream:  "RTSP/1.0 200 OK\r\nX-Junk: " + strings.Repeat("a", rtspMaxHeaderLen) + "\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "content length too large",
+			stream:  "RTSP/1.0 200 OK\r\nContent-Length: 1073741824\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative content length",
+			stream:  "RTSP/1.0 200 OK\r\nContent-Length: -1\r\n\r\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRTSPStreamReader(strings.NewReader(tt.stream))
+			for _, want := range tt.want {
+				msg, err := r.next()
+				if err != nil {
+					t.Fatalf("next() error = %v", err)
+				}
+				if !bytes.Equal(msg.raw, []byte(want)) {
+					t.Errorf("next() = %q, want %q", msg.raw, want)
+				}
+			}
+			if _, err := r.next(); tt.wantErr && err == nil {
+				t.Error("next() succeeded, want error")
+			}
+		})
+	}
+}
@@ -39,10 +39,6 @@ func genBranch() string {
 	return "z9hG4bK" + randDigits(7)
 }
 
-func isValidCandidate(candidate string) bool {
-	return !strings.Contains(candidate, ":") && !strings.Contains(candidate, ".local")
-}
-
 type Duration = time.Duration
 
 type SIPInfo struct {
@@ -69,6 +65,15 @@ type SIPInfo struct {
 	// will manage the media traffic, and this SIP client is only
 	// used to manage signaling
 	SDP string
+
+	// send the INVITE as soon as host candidates are gathered and
+	// trickle the rest to the remote in INFO requests (RFC 8840),
+	// instead of waiting for gathering to finish
+	TrickleICE bool
+
+	// how long to wait for ICE gathering to finish, 0 waits until
+	// every candidate is gathered
+	ICEGatheringTimeout Duration
 }
 
 type HeadersMap map[string]string
@@ -253,18 +258,47 @@ type SIPWebRTCManager struct {
 	webrtc  *WebRTCManager
 	sipInfo SIPInfo
 
+	// shared with webrtc, kept here so that it's available even if
+	// webrtc isn't
+	logger *Logger
+
 	wsConn          *websocket.Conn
 	tlsKeylogWriter io.WriteCloser
 
 	randHost string
+	contact  *sip.Addr
 	timeout  Duration
 
+	// the established call, and the CSeq of the last request sent in it
 	inviteResp        *sip.Msg
+	dialogCSeq        int
 	inviteRespMsgLock *sync.Mutex
+
+	// reads and routes all incoming sip messages
+	dispatcher *sipDispatcher
+
+	closeOnce *sync.Once
+	closed    chan struct{}
 }
 
 func NewSIPWebRTCManager(infoLoggerPort, debugLoggerPort int, iceServers []WebRTCICEServer, sipInfo SIPInfo) (*SIPWebRTCManager, error) {
-	wm, err := newWebRTCManager(infoLoggerPort, debugLoggerPort, iceServers, "SIPWebRTCManager")
+	return NewSIPWebRTCManagerWithOptions(infoLoggerPort, debugLoggerPort, iceServers, nil, sipInfo)
+}
+
+// NewSIPWebRTCManagerWithOptions creates a SIPWebRTCManager configured by
+// options, which may be nil to use the defaults.
+func NewSIPWebRTCManagerWithOptions(infoLoggerPort, debugLoggerPort int, iceServers []WebRTCICEServer, options *WebRTCOptions, sipInfo SIPInfo) (*SIPWebRTCManager, error) {
+	if options == nil {
+		options = NewWebRTCOptions()
+	}
+	if options.CandidatePolicy == nil {
+		// keep the caller's options untouched
+		withDefault := *options
+		withDefault.CandidatePolicy = DefaultICECandidatePolicy()
+		options = &withDefault
+	}
+
+	wm, err := newWebRTCManager(infoLoggerPort, debugLoggerPort, iceServers, options, "SIPWebRTCManager")
 	if err != nil {
 		return nil, err
 	}
@@ -272,10 +306,22 @@ func NewSIPWebRTCManager(infoLoggerPort, debugLoggerPort int, iceServers []WebRT
 	sm := &SIPWebRTCManager{
 		webrtc:            wm,
 		sipInfo:           sipInfo,
+		logger:            wm.GetLogger(),
 		inviteRespMsgLock: &sync.Mutex{},
 		randHost:          randString(12) + ".invalid",
 		timeout:           5 * time.Second,
+		closeOnce:         &sync.Once{},
+		closed:            make(chan struct{}),
+	}
+	sm.contact = &sip.Addr{
+		Uri: &sip.URI{
+			Scheme: "sip",
+			User:   randString(8),
+			Host:   sm.randHost + ";transport=ws;ob",
+		},
 	}
+	sm.dispatcher = newSIPDispatcher(sm)
+	sm.registerRequestHandlers()
 	sm.sipInfo.from, err = sip.ParseURI([]byte(sm.sipInfo.CallerURI))
 	if err != nil {
 		return nil, fmt.Errorf("could not parse caller uri: %w", err)
@@ -285,25 +331,18 @@ func NewSIPWebRTCManager(infoLoggerPort, debugLoggerPort int, iceServers []WebRT
 		return nil, fmt.Errorf("could not parse callee uri: %w", err)
 	}
 
-	wm.pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		if s == webrtc.PeerConnectionStateDisconnected {
-			sm.Close()
-		}
-	})
+	// the call is torn down along with the peer connection, and ICE
+	// restarts are offered to the remote by re-INVITE
+	wm.closeFunc = sm.Close
+	wm.restartICE = sm.reinviteBefore
 
 	return sm, nil
 }
 
-func (sm *SIPWebRTCManager) Info(msg string, args ...any) {
-	if sm.webrtc != nil {
-		sm.webrtc.Info(msg, args...)
-	}
-}
-
-func (sm *SIPWebRTCManager) Debug(msg string, args ...any) {
-	if sm.webrtc != nil {
-		sm.webrtc.Debug(msg, args...)
-	}
+// GetLogger returns the manager's logger, e.g. to set the device ID field,
+// the level or the output format.
+func (sm *SIPWebRTCManager) GetLogger() *Logger {
+	return sm.logger
 }
 
 /*
@@ -332,6 +371,26 @@ func (sm *SIPWebRTCManager) InitializeAudioRTPListener(codecMimeType string) (po
 	return sm.webrtc.InitializeAudioRTPListener(codecMimeType)
 }
 
+func (sm *SIPWebRTCManager) InitializeAudioPCMEncoder(codecMimeType string, sampleRate, channels int) (port int, err error) {
+	return sm.webrtc.InitializeAudioPCMEncoder(codecMimeType, sampleRate, channels)
+}
+
+func (sm *SIPWebRTCManager) WriteAudioPCM(data []byte) error {
+	return sm.webrtc.WriteAudioPCM(data)
+}
+
+func (sm *SIPWebRTCManager) InitializeAudioRTPForwarder(port, payloadType int) error {
+	return sm.webrtc.InitializeAudioRTPForwarder(port, payloadType)
+}
+
+func (sm *SIPWebRTCManager) InitializeVideoRTPForwarder(port, payloadType int) error {
+	return sm.webrtc.InitializeVideoRTPForwarder(port, payloadType)
+}
+
+func (sm *SIPWebRTCManager) RequestKeyframe() error {
+	return sm.webrtc.RequestKeyframe()
+}
+
 func (sm *SIPWebRTCManager) connectWebsocket() error {
 	cfg, err := websocket.NewConfig(sm.sipInfo.WebsocketURI, sm.sipInfo.WebsocketOrigin)
 	if err != nil {
@@ -351,11 +410,24 @@ func (sm *SIPWebRTCManager) connectWebsocket() error {
 		return fmt.Errorf("could not dial websocket: %w", err)
 	}
 
+	sm.dispatcher.start(sm.wsConn)
+	go func() {
+		<-sm.dispatcher.done
+		select {
+		case <-sm.closed:
+		default:
+			sm.logger.Warn("SIP websocket closed unexpectedly: %s", sm.dispatcher.lastError())
+			sm.Close()
+		}
+	}()
+
 	return nil
 }
 
+var sipOfferOptions = &webrtc.OfferOptions{OfferAnswerOptions: webrtc.OfferAnswerOptions{VoiceActivityDetection: true}}
+
 func (sm *SIPWebRTCManager) makeLocalSDP() (string, error) {
-	offer, err := sm.webrtc.pc.CreateOffer(&webrtc.OfferOptions{OfferAnswerOptions: webrtc.OfferAnswerOptions{VoiceActivityDetection: true}})
+	offer, err := sm.webrtc.pc.CreateOffer(sipOfferOptions)
 	if err != nil {
 		return "", fmt.Errorf("could not create offer sdp: %w", err)
 	}
@@ -365,14 +437,29 @@ func (sm *SIPWebRTCManager) makeLocalSDP() (string, error) {
 		return "", fmt.Errorf("could not set local description: %w", err)
 	}
 
-	for end := error(nil); end == nil; _, end = sm.webrtc.GetNextICECandidate() {
-		continue
+	if !sm.waitForGathering(sm.sipInfo.ICEGatheringTimeout) {
+		sm.logger.Info("ICE gathering timed out, sending the candidates found so far")
 	}
 	offer = *sm.webrtc.pc.LocalDescription()
 
 	return offer.SDP, nil
 }
 
+// filterCandidates removes candidates that the ICE candidate policy
+// doesn't allow from localSDP.
+func (sm *SIPWebRTCManager) filterCandidates(localSDP string) string {
+	tokens := strings.Split(localSDP, "\r\n")
+	tokens = slices.DeleteFunc[[]string](tokens, func(s string) bool {
+		const candidatePrefix = "a=candidate:"
+		if strings.HasPrefix(s, candidatePrefix) && !sm.webrtc.candidatePolicy.allowsSDPCandidate(s[len(candidatePrefix):]) {
+			sm.logger.Debug("Filtered out candidate: %s", s)
+			return true
+		}
+		return false
+	})
+	return strings.Join(tokens, "\r\n")
+}
+
 func (sm *SIPWebRTCManager) makeInvite(localSDP string) *sip.Msg {
 	invite := &sip.Msg{
 		CallID:     util.GenerateCallID(),
@@ -400,13 +487,7 @@ func (sm *SIPWebRTCManager) makeInvite(localSDP string) *sip.Msg {
 		To: &sip.Addr{
 			Uri: sm.sipInfo.to.Copy(),
 		},
-		Contact: &sip.Addr{
-			Uri: &sip.URI{
-				Scheme: "sip",
-				User:   randString(8),
-				Host:   sm.randHost + ";transport=ws;ob",
-			},
-		},
+		Contact:   sm.contact.Copy(),
 		UserAgent: sm.sipInfo.UserAgent,
 		Payload: &sip.MiscPayload{
 			T: sdp.ContentType,
@@ -417,11 +498,21 @@ func (sm *SIPWebRTCManager) makeInvite(localSDP string) *sip.Msg {
 	return invite
 }
 
-func (sm *SIPWebRTCManager) verify100Trying(msg *sip.Msg) error {
-	if !msg.IsResponse() || msg.Status != sip.StatusTrying {
-		return fmt.Errorf("did not receive 100 trying, got %d %s", msg.Status, msg.Phrase)
+// makeReinvite builds an INVITE within the established call. Must be
+// called with inviteRespMsgLock held.
+func (sm *SIPWebRTCManager) makeReinvite(localSDP string) *sip.Msg {
+	reinvite := sm.makeDialogRequest(sip.MethodInvite)
+	reinvite.Allow = "ACK,CANCEL,INVITE,MESSAGE,BYE,OPTIONS,INFO,NOTIFY,REFER"
+	reinvite.XHeader = &sip.XHeader{
+		Name:  "X-extension",
+		Value: []byte(sm.sipInfo.DeviceID + "; User-Agent: webrtc"),
 	}
-	return nil
+	reinvite.Contact = sm.contact.Copy()
+	reinvite.Payload = &sip.MiscPayload{
+		T: sdp.ContentType,
+		D: []byte(localSDP),
+	}
+	return reinvite
 }
 
 func (sm *SIPWebRTCManager) verify200OK(msg *sip.Msg) error {
@@ -471,12 +562,15 @@ func (sm *SIPWebRTCManager) makeAck(msg *sip.Msg) *sip.Msg {
 	}
 }
 
-func (sm *SIPWebRTCManager) makeBye(msg *sip.Msg) *sip.Msg {
-	ack := sm.makeAck(msg)
-	ack.Method = sip.MethodBye
-	ack.CSeqMethod = sip.MethodBye
-	ack.CSeq++
-	return ack
+// makeDialogRequest builds a request within the established call, using
+// the next CSeq. Must be called with inviteRespMsgLock held.
+func (sm *SIPWebRTCManager) makeDialogRequest(method string) *sip.Msg {
+	sm.dialogCSeq++
+	req := sm.makeAck(sm.inviteResp)
+	req.Method = method
+	req.CSeqMethod = method
+	req.CSeq = sm.dialogCSeq
+	return req
 }
 
 func (sm *SIPWebRTCManager) makeMessage(payload string) *sip.Msg {
@@ -509,43 +603,85 @@ func (sm *SIPWebRTCManager) makeMessage(payload string) *sip.Msg {
 	return message
 }
 
+// makeResponse builds a response to a request sent to us by the remote end.
+func (sm *SIPWebRTCManager) makeResponse(req *sip.Msg, status int) *sip.Msg {
+	to := req.To.Copy()
+	if to.Param.Get("tag") == nil {
+		to.Param = &sip.Param{Name: "tag", Value: util.GenerateTag(), Next: to.Param}
+	}
+
+	return &sip.Msg{
+		Status:      status,
+		Phrase:      sip.Phrase(status),
+		Via:         req.Via,
+		From:        req.From,
+		To:          to,
+		CallID:      req.CallID,
+		CSeq:        req.CSeq,
+		CSeqMethod:  req.CSeqMethod,
+		RecordRoute: req.RecordRoute,
+		Supported:   "outbound",
+		UserAgent:   sm.sipInfo.UserAgent,
+	}
+}
+
+func (sm *SIPWebRTCManager) respond(req *sip.Msg, status int) {
+	if err := sm.writeWebsocket(sm.makeResponse(req, status)); err != nil {
+		sm.logger.Warn("Could not respond to sip %s request: %s", req.Method, err)
+	}
+}
+
+func (sm *SIPWebRTCManager) registerRequestHandlers() {
+	ok := func(req *sip.Msg) {
+		sm.respond(req, sip.StatusOK)
+	}
+	sm.dispatcher.handle(sip.MethodNotify, ok)
+	sm.dispatcher.handle(sip.MethodOptions, ok)
+	sm.dispatcher.handle(sip.MethodInfo, func(req *sip.Msg) {
+		if req.Payload != nil && req.Payload.ContentType() == sipTrickleContentType {
+			sm.handleTrickleInfo(req)
+		}
+		sm.respond(req, sip.StatusOK)
+	})
+	sm.dispatcher.handle(sip.MethodInvite, func(req *sip.Msg) {
+		// we have no way to renegotiate media mid-call, so reject any
+		// re-INVITE and keep the existing session as-is
+		sm.logger.Info("Rejecting re-INVITE from remote")
+		sm.respond(req, sip.StatusNotAcceptableHere)
+	})
+	sm.dispatcher.handle(sip.MethodBye, func(req *sip.Msg) {
+		sm.logger.Info("Remote ended the call")
+		sm.respond(req, sip.StatusOK)
+
+		// the dialog is gone, so don't send our own BYE when closing
+		sm.inviteRespMsgLock.Lock()
+		sm.inviteResp = nil
+		sm.inviteRespMsgLock.Unlock()
+
+		go sm.Close()
+	})
+}
+
 func (sm *SIPWebRTCManager) writeWebsocket(msg *sip.Msg) error {
 	msgStr := msg.String()
 	msgStr = strings.ReplaceAll(msgStr, "WebRTC-UDP", "\"WebRTC-UDP\"")
-	sm.Debug("Sending sip message:\n%s", msgStr)
+	sm.logger.Debug("Sending sip message:\n%s", msgStr)
 	sm.wsConn.SetWriteDeadline(time.Now().Add(sm.timeout))
 	_, err := sm.wsConn.Write([]byte(msgStr))
 	return err
 }
 
-func (sm *SIPWebRTCManager) readWebsocket() (*sip.Msg, error) {
-	var readBuf = make([]byte, 4096)
-
-	sm.wsConn.SetReadDeadline(time.Now().Add(sm.timeout))
-	n, err := sm.wsConn.Read(readBuf)
-	if err != nil {
-		return nil, fmt.Errorf("could not read websocket: %w", err)
-	}
-
-	sm.Debug("Got sip response:\n%s", string(readBuf[0:n]))
-
-	msg, err := sip.ParseMsg(readBuf[0:n])
-	if err != nil {
-		return nil, fmt.Errorf("could not parse sip message: %w", err)
-	}
-
-	if msg.Payload != nil && msg.Payload.ContentType() == sdp.ContentType {
-		// gosip's sdp parsing is buggy, so this workaround is to force a parsing
-		// that retains the original data
-		patched := strings.Replace(string(readBuf[0:n]), fmt.Sprintf("Content-Type: %s", sdp.ContentType), fmt.Sprintf("Content-Type: %s", "application/sdp1"), 1)
-		msg, err = sip.ParseMsg([]byte(patched))
-		if err != nil {
-			return nil, fmt.Errorf("could not parse patched sip message: %w", err)
-		}
-		msg.Payload.(*sip.MiscPayload).T = sdp.ContentType
-	}
+// request sends req in a new client transaction and waits for its
+// final response.
+func (sm *SIPWebRTCManager) request(req *sip.Msg) (*sip.Msg, error) {
+	return sm.newClientTransaction(req).run()
+}
 
-	return msg, nil
+// requestBefore is like request, but gives up at deadline.
+func (sm *SIPWebRTCManager) requestBefore(req *sip.Msg, deadline time.Time) (*sip.Msg, error) {
+	tx := sm.newClientTransaction(req)
+	tx.deadline = deadline
+	return tx.run()
 }
 
 func (sm *SIPWebRTCManager) sendAck(msg *sip.Msg) error {
@@ -553,8 +689,8 @@ func (sm *SIPWebRTCManager) sendAck(msg *sip.Msg) error {
 }
 
 func (sm *SIPWebRTCManager) Start() (remoteSDP string, err error) {
-	if sm.sipInfo.SDP == "" && sm.webrtc.audioRTP == nil {
-		return "", fmt.Errorf("audio rtp listener not initialized")
+	if sm.sipInfo.SDP == "" && sm.webrtc.audioRTP == nil && sm.webrtc.getAudioPCM() == nil && sm.webrtc.getForwarder(webrtc.RTPCodecTypeAudio) == nil {
+		return "", fmt.Errorf("audio rtp listener, pcm encoder or forwarder not initialized")
 	}
 
 	defer func() {
@@ -568,48 +704,37 @@ func (sm *SIPWebRTCManager) Start() (remoteSDP string, err error) {
 	}
 
 	var localSDP string = sm.sipInfo.SDP
-	if localSDP == "" {
+	var trickled map[string]bool
+	if localSDP == "" && sm.sipInfo.TrickleICE {
+		localSDP, trickled, err = sm.makeTrickleSDP()
+		if err != nil {
+			return "", fmt.Errorf("could not create local sdp: %w", err)
+		}
+	} else if localSDP == "" {
 		// need to generate sdp
 		localSDP, err = sm.makeLocalSDP()
 		if err != nil {
 			return "", fmt.Errorf("could not create local sdp: %w", err)
 		}
 
-		tokens := strings.Split(localSDP, "\r\n")
-		tokens = slices.DeleteFunc[[]string](tokens, func(s string) bool {
-			const candidatePrefix = "a=candidate:"
-			if strings.HasPrefix(s, candidatePrefix) && !isValidCandidate(s[len(candidatePrefix):]) {
-				sm.Debug("Filtered out candidate: %s", s)
-				return true
-			}
-			return false
-		})
-		localSDP = strings.Join(tokens, "\r\n")
+		localSDP = sm.filterCandidates(localSDP)
 	}
 
 	invite := sm.makeInvite(localSDP)
-	if err = sm.writeWebsocket(invite); err != nil {
-		return "", fmt.Errorf("could not send invite over websocket: %w", err)
-	}
-
-	trying, err := sm.readWebsocket()
-	if err != nil {
-		return "", fmt.Errorf("could not read invite response: %w", err)
-	}
-	if err = sm.verify100Trying(trying); err != nil {
-		return "", fmt.Errorf("could not parse 100 trying: %w", err)
+	if trickled != nil {
+		invite.Supported = "outbound, trickle-ice"
+		invite.XHeader.Next = &sip.XHeader{
+			Name:  "Recv-Info",
+			Value: []byte(sipTrickleInfoPackage),
+		}
 	}
-
-	inviteResponse, err := sm.readWebsocket()
+	inviteResponse, err := sm.request(invite)
 	if err != nil {
 		return "", fmt.Errorf("could not read invite response: %w", err)
 	}
 	if sm.verify407ProxyAuthenticationRequired(inviteResponse) == nil {
-		// for 407, we need to respond with an ack then add the auth header to the invite
-		if err := sm.sendAck(inviteResponse); err != nil {
-			return "", fmt.Errorf("could not send ack: %w", err)
-		}
-
+		// for 407, the transaction has already acked the response, so we
+		// only need to add the auth header to the invite
 		authHeader, err := ParseAuthHeader(inviteResponse.ProxyAuthenticate)
 		if err != nil {
 			return "", fmt.Errorf("could not parse Proxy-Authenticate from 407 response: %w", err)
@@ -626,19 +751,7 @@ func (sm *SIPWebRTCManager) Start() (remoteSDP string, err error) {
 		invite.Via.Param = &sip.Param{Name: "branch", Value: genBranch()}
 		invite.CSeq++
 
-		if err = sm.writeWebsocket(invite); err != nil {
-			return "", fmt.Errorf("could not send invite over websocket: %w", err)
-		}
-
-		trying, err = sm.readWebsocket()
-		if err != nil {
-			return "", fmt.Errorf("could not read invite response: %w", err)
-		}
-		if err = sm.verify100Trying(trying); err != nil {
-			return "", fmt.Errorf("could not parse 100 trying: %w", err)
-		}
-
-		inviteResponse, err = sm.readWebsocket()
+		inviteResponse, err = sm.request(invite)
 		if err != nil {
 			return "", fmt.Errorf("could not read invite response: %w", err)
 		}
@@ -649,6 +762,7 @@ func (sm *SIPWebRTCManager) Start() (remoteSDP string, err error) {
 
 	sm.inviteRespMsgLock.Lock()
 	sm.inviteResp = inviteResponse
+	sm.dialogCSeq = inviteResponse.CSeq
 	sm.inviteRespMsgLock.Unlock()
 
 	if inviteResponse.Payload.ContentType() != sdp.ContentType {
@@ -672,53 +786,31 @@ func (sm *SIPWebRTCManager) Start() (remoteSDP string, err error) {
 		return "", fmt.Errorf("could not send ack: %w", err)
 	}
 
-	if sm.sipInfo.SDP == "" {
-		startTalk := sm.makeMessage(fmt.Sprintf("deviceId:%s;startTalk", sm.sipInfo.DeviceID))
-		if err = sm.writeWebsocket(startTalk); err != nil {
-			return "", fmt.Errorf("could not send startTalk over websocket: %w", err)
-		}
-	}
-
-	keepAlive := sm.makeMessage("keepAlive")
-	if err = sm.writeWebsocket(keepAlive); err != nil {
-		return "", fmt.Errorf("could not send keepAlive over websocket: %w", err)
+	if trickled != nil {
+		go sm.trickleCandidates(trickled)
 	}
 
 	if sm.sipInfo.SDP == "" {
-		startTalkResponse, err := sm.readWebsocket()
-		if err != nil {
-			return "", fmt.Errorf("could not read startTalk response: %w", err)
-		}
-		if err = sm.verify202Accepted(startTalkResponse); err != nil {
-			return "", fmt.Errorf("could not parse 202 accepted: %w", err)
+		if err = sm.StartTalk(); err != nil {
+			return "", err
 		}
 	}
 
-	keepAliveResponse, err := sm.readWebsocket()
-	if err != nil {
-		return "", fmt.Errorf("could not read keepAlive response: %w", err)
-	}
-	if err = sm.verify202Accepted(keepAliveResponse); err != nil {
-		return "", fmt.Errorf("could not parse 202 accepted: %w", err)
+	if err = sm.sendKeepAlive(); err != nil {
+		return "", err
 	}
 
 	// keepAlive loop
 	go func() {
 		for {
-			time.Sleep(30 * time.Second)
-
-			keepAlive := sm.makeMessage("keepAlive")
-			if err = sm.writeWebsocket(keepAlive); err != nil {
-				sm.Info("Could not send keepAlive over websocket: %s", err)
-				break
+			select {
+			case <-sm.closed:
+				return
+			case <-time.After(30 * time.Second):
 			}
 
-			keepAliveResponse, err := sm.readWebsocket()
-			if err != nil {
-				sm.Info("Could not read keepAlive response: %s", err)
-				break
-			} else if err = sm.verify202Accepted(keepAliveResponse); err != nil {
-				sm.Info("Could not parse 202 accepted: %s", err)
+			if err := sm.sendKeepAlive(); err != nil {
+				sm.logger.Warn("%s", err)
 				break
 			}
 		}
@@ -726,19 +818,94 @@ func (sm *SIPWebRTCManager) Start() (remoteSDP string, err error) {
 	}()
 
 	if sm.sipInfo.SDP == "" {
-		sm.Info("Started SIP push to talk")
+		sm.logger.Info("Started SIP push to talk")
 		sm.webrtc.PrintTimeSinceCreation()
 	}
 
 	return remoteSDP, nil
 }
 
+// reinvite sends a new offer to the remote within the current call and
+// applies its answer.
+func (sm *SIPWebRTCManager) reinvite(offerSDP string) error {
+	return sm.reinviteBefore(offerSDP, time.Time{})
+}
+
+// reinviteBefore is like reinvite, but gives up at deadline if it is set,
+// so that an unresponsive remote can't hold up recovery for the length of
+// the INVITE timers.
+func (sm *SIPWebRTCManager) reinviteBefore(offerSDP string, deadline time.Time) error {
+	sm.inviteRespMsgLock.Lock()
+	if sm.inviteResp == nil {
+		sm.inviteRespMsgLock.Unlock()
+		return fmt.Errorf("no call in progress")
+	}
+	reinvite := sm.makeReinvite(sm.filterCandidates(offerSDP))
+	sm.inviteRespMsgLock.Unlock()
+
+	resp, err := sm.requestBefore(reinvite, deadline)
+	if err != nil {
+		return fmt.Errorf("could not read re-INVITE response: %w", err)
+	}
+	if err = sm.verify200OK(resp); err != nil {
+		return fmt.Errorf("could not parse 200 ok: %w", err)
+	}
+
+	// the call continues with the remote's latest view of it
+	sm.inviteRespMsgLock.Lock()
+	sm.inviteResp = resp
+	sm.inviteRespMsgLock.Unlock()
+
+	if err = sm.sendAck(resp); err != nil {
+		return fmt.Errorf("could not send ack: %w", err)
+	}
+
+	if resp.Payload.ContentType() != sdp.ContentType {
+		return fmt.Errorf("unexpected re-INVITE response content type %q", resp.Payload.ContentType())
+	}
+	err = sm.webrtc.SetRemoteDescription(WebRTCSessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  cleanSDP(string(resp.Payload.Data())),
+	})
+	if err != nil {
+		return fmt.Errorf("could not set remote description: %w", err)
+	}
+	return nil
+}
+
+// EnableRecovery keeps the call alive for up to gracePeriod after the
+// connection is lost, restarting ICE by re-INVITE in the meantime. A
+// re-INVITE that is still unanswered when the grace period ends is given
+// up on.
+func (sm *SIPWebRTCManager) EnableRecovery(gracePeriod Duration) {
+	sm.webrtc.EnableRecovery(gracePeriod)
+}
+
+// SetStateCallback registers cb to be called with the new state whenever
+// it changes.
+func (sm *SIPWebRTCManager) SetStateCallback(cb func(state string)) {
+	sm.webrtc.SetStateCallback(cb)
+}
+
+// GetState returns the current state of the call.
+func (sm *SIPWebRTCManager) GetState() string {
+	return sm.webrtc.GetState()
+}
+
+func (sm *SIPWebRTCManager) sendKeepAlive() error {
+	keepAliveResponse, err := sm.request(sm.makeMessage("keepAlive"))
+	if err != nil {
+		return fmt.Errorf("could not read keepAlive response: %w", err)
+	}
+	if err = sm.verify202Accepted(keepAliveResponse); err != nil {
+		return fmt.Errorf("could not parse 202 accepted: %w", err)
+	}
+	return nil
+}
+
 func (sm *SIPWebRTCManager) StartTalk() error {
 	startTalk := sm.makeMessage(fmt.Sprintf("deviceId:%s;startTalk", sm.sipInfo.DeviceID))
-	if err := sm.writeWebsocket(startTalk); err != nil {
-		return fmt.Errorf("could not send startTalk over websocket: %w", err)
-	}
-	startTalkResponse, err := sm.readWebsocket()
+	startTalkResponse, err := sm.request(startTalk)
 	if err != nil {
 		return fmt.Errorf("could not read startTalk response: %w", err)
 	}
@@ -750,12 +917,9 @@ func (sm *SIPWebRTCManager) StartTalk() error {
 
 func (sm *SIPWebRTCManager) StopTalk() error {
 	stopTalk := sm.makeMessage(fmt.Sprintf("deviceId:%s;stopTalk", sm.sipInfo.DeviceID))
-	if err := sm.writeWebsocket(stopTalk); err != nil {
-		return fmt.Errorf("could not send startTalk over websocket: %w", err)
-	}
-	stopTalkResponse, err := sm.readWebsocket()
+	stopTalkResponse, err := sm.request(stopTalk)
 	if err != nil {
-		return fmt.Errorf("could not read startTalk response: %w", err)
+		return fmt.Errorf("could not read stopTalk response: %w", err)
 	}
 	if err = sm.verify202Accepted(stopTalkResponse); err != nil {
 		return fmt.Errorf("could not parse 202 accepted: %w", err)
@@ -764,23 +928,29 @@ func (sm *SIPWebRTCManager) StopTalk() error {
 }
 
 func (sm *SIPWebRTCManager) Close() {
-	sm.inviteRespMsgLock.Lock()
-	defer sm.inviteRespMsgLock.Unlock()
+	sm.closeOnce.Do(func() {
+		close(sm.closed)
 
-	if sm.inviteResp != nil {
-		bye := sm.makeBye(sm.inviteResp)
-		sm.writeWebsocket(bye)
-	}
+		sm.inviteRespMsgLock.Lock()
+		defer sm.inviteRespMsgLock.Unlock()
 
-	sm.wsConn.Close()
+		if sm.wsConn != nil {
+			if sm.inviteResp != nil {
+				bye := sm.makeDialogRequest(sip.MethodBye)
+				sm.writeWebsocket(bye)
+			}
+			sm.wsConn.Close()
+		}
+		sm.dispatcher.stop(errDispatcherClosed)
 
-	if sm.tlsKeylogWriter != nil {
-		sm.tlsKeylogWriter.Close()
-	}
+		if sm.tlsKeylogWriter != nil {
+			sm.tlsKeylogWriter.Close()
+		}
 
-	if sm.sipInfo.SDP == "" {
-		sm.webrtc.Close()
-	}
+		if sm.sipInfo.SDP == "" {
+			sm.webrtc.Close()
+		}
+	})
 }
 
 func init() {
@@ -0,0 +1,204 @@
+package scrypted_arlo_go
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jart/gosip/sdp"
+	"github.com/jart/gosip/sip"
+	"golang.org/x/net/websocket"
+)
+
+var errDispatcherClosed = errors.New("sip dispatcher closed")
+
+// sipRequestHandler processes a request sent to us by the remote end,
+// such as an in-dialog NOTIFY or BYE. Handlers are responsible for
+// sending any response.
+type sipRequestHandler func(req *sip.Msg)
+
+// sipDispatcher owns the read side of the SIP websocket. A single goroutine
+// parses every incoming frame, routes responses to whoever is waiting on the
+// matching request, and hands requests from the remote end to handlers.
+type sipDispatcher struct {
+	sm *SIPWebRTCManager
+
+	lock     *sync.Mutex
+	pending  map[string]chan *sip.Msg
+	handlers map[string]sipRequestHandler
+	err      error
+
+	done chan struct{}
+}
+
+func newSIPDispatcher(sm *SIPWebRTCManager) *sipDispatcher {
+	return &sipDispatcher{
+		sm:       sm,
+		lock:     &sync.Mutex{},
+		pending:  map[string]chan *sip.Msg{},
+		handlers: map[string]sipRequestHandler{},
+		done:     make(chan struct{}),
+	}
+}
+
+// sipTransactionKey identifies the request a message belongs to. Responses
+// carry the Call-ID, CSeq and top Via branch of the request they answer,
+// so the same key is produced for a request and all of its responses.
+func sipTransactionKey(msg *sip.Msg) string {
+	branch := ""
+	if msg.Via != nil {
+		if p := msg.Via.Param.Get("branch"); p != nil {
+			branch = p.Value
+		}
+	}
+	return fmt.Sprintf("%s|%d|%s|%s", msg.CallID, msg.CSeq, msg.CSeqMethod, branch)
+}
+
+func parseSIPMessage(data []byte) (*sip.Msg, error) {
+	msg, err := sip.ParseMsg(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse sip message: %w", err)
+	}
+
+	if msg.Payload != nil && msg.Payload.ContentType() == sdp.ContentType {
+		// gosip's sdp parsing is buggy, so this workaround is to force a parsing
+		// that retains the original data
+		patched := strings.Replace(string(data), fmt.Sprintf("Content-Type: %s", sdp.ContentType), fmt.Sprintf("Content-Type: %s", "application/sdp1"), 1)
+		msg, err = sip.ParseMsg([]byte(patched))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse patched sip message: %w", err)
+		}
+		msg.Payload.(*sip.MiscPayload).T = sdp.ContentType
+	}
+
+	return msg, nil
+}
+
+// handle registers a handler for requests with the given method
+// sent to us by the remote end.
+func (d *sipDispatcher) handle(method string, handler sipRequestHandler) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.handlers[method] = handler
+}
+
+// register returns a channel on which all responses to req are delivered.
+// This must be called before req is written to the websocket, otherwise a
+// fast response may arrive before anyone is listening for it. The channel
+// is closed if the dispatcher stops.
+func (d *sipDispatcher) register(req *sip.Msg) (<-chan *sip.Msg, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	key := sipTransactionKey(req)
+	ch := make(chan *sip.Msg, 8)
+	d.pending[key] = ch
+	return ch, nil
+}
+
+func (d *sipDispatcher) unregister(req *sip.Msg) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.pending, sipTransactionKey(req))
+}
+
+// lastError returns the reason the dispatcher stopped, if any.
+func (d *sipDispatcher) lastError() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.err == nil {
+		return errDispatcherClosed
+	}
+	return d.err
+}
+
+func (d *sipDispatcher) start(wsConn *websocket.Conn) {
+	go func() {
+		defer close(d.done)
+		for {
+			var frame []byte
+			if err := websocket.Message.Receive(wsConn, &frame); err != nil {
+				d.stop(fmt.Errorf("could not read websocket: %w", err))
+				return
+			}
+
+			d.sm.logger.Debug("Got sip message:\n%s", string(frame))
+
+			msg, err := parseSIPMessage(frame)
+			if err != nil {
+				d.sm.logger.Warn("Dropping unparseable sip message: %s", err)
+				continue
+			}
+
+			if msg.IsResponse() {
+				d.dispatchResponse(msg)
+			} else {
+				d.dispatchRequest(msg)
+			}
+		}
+	}()
+}
+
+func (d *sipDispatcher) dispatchResponse(msg *sip.Msg) {
+	// the send happens under the lock, since stop closes the channel
+	d.lock.Lock()
+	ch, ok := d.pending[sipTransactionKey(msg)]
+	delivered := false
+	if ok {
+		select {
+		case ch <- msg:
+			delivered = true
+		default:
+		}
+	}
+	d.lock.Unlock()
+
+	if !ok {
+		d.sm.logger.Debug("Dropping unsolicited sip response %d %s for %s", msg.Status, msg.Phrase, msg.CSeqMethod)
+	} else if !delivered {
+		d.sm.logger.Debug("Dropping sip response %d %s, waiter is not keeping up", msg.Status, msg.Phrase)
+	}
+}
+
+func (d *sipDispatcher) dispatchRequest(msg *sip.Msg) {
+	d.lock.Lock()
+	handler, ok := d.handlers[msg.Method]
+	d.lock.Unlock()
+
+	if ok {
+		handler(msg)
+		return
+	}
+
+	if msg.Method == sip.MethodAck {
+		// ACKs never get a response
+		return
+	}
+
+	d.sm.logger.Debug("No handler for sip %s request", msg.Method)
+	if err := d.sm.writeWebsocket(d.sm.makeResponse(msg, sip.StatusNotImplemented)); err != nil {
+		d.sm.logger.Warn("Could not respond to sip %s request: %s", msg.Method, err)
+	}
+}
+
+// stop fails all outstanding waiters with err. Subsequent calls to
+// register will return err.
+func (d *sipDispatcher) stop(err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.err != nil {
+		return
+	}
+	d.err = err
+
+	for key, ch := range d.pending {
+		close(ch)
+		delete(d.pending, key)
+	}
+}
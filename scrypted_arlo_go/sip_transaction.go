@@ -0,0 +1,222 @@
+package scrypted_arlo_go
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jart/gosip/sip"
+)
+
+// RFC 3261 timer values, see section 17.1.1.1 and table 4
+const (
+	sipT1 = 500 * time.Millisecond
+
+	// Timer B for INVITE and Timer F otherwise, how long to wait for a
+	// response before giving up on the request
+	sipTransactionTimeout = 64 * sipT1
+
+	// how long retransmitted 2xx responses to an INVITE are ACKed, see
+	// section 13.2.2.4
+	sip2xxRetransmitTimeout = 64 * sipT1
+
+	// Timer C, how long an INVITE may stay in proceeding after
+	// the last provisional response
+	sipProceedingTimeout = 3 * time.Minute
+)
+
+type sipTransactionState int
+
+const (
+	sipTransactionCalling sipTransactionState = iota
+	sipTransactionProceeding
+	sipTransactionCompleted
+	sipTransactionTerminated
+)
+
+func (s sipTransactionState) String() string {
+	switch s {
+	case sipTransactionCalling:
+		return "calling"
+	case sipTransactionProceeding:
+		return "proceeding"
+	case sipTransactionCompleted:
+		return "completed"
+	case sipTransactionTerminated:
+		return "terminated"
+	}
+	return "unknown"
+}
+
+// sipClientTransaction implements the INVITE and non-INVITE client
+// transaction state machines from RFC 3261 section 17.1. The websocket is
+// a reliable transport, so requests are never retransmitted (Timers A and
+// E) and completed transactions terminate immediately (Timers D and K are
+// zero).
+type sipClientTransaction struct {
+	sm     *SIPWebRTCManager
+	req    *sip.Msg
+	invite bool
+	state  sipTransactionState
+
+	// if set, the transaction times out by then regardless of Timers B,
+	// C and F
+	deadline time.Time
+
+	responses <-chan *sip.Msg
+}
+
+func (sm *SIPWebRTCManager) newClientTransaction(req *sip.Msg) *sipClientTransaction {
+	// callers may reuse and modify req for a follow-up request, e.g. when
+	// retrying with credentials, so keep our own copy
+	return &sipClientTransaction{
+		sm:     sm,
+		req:    req.Copy(),
+		invite: req.Method == sip.MethodInvite,
+		state:  sipTransactionCalling,
+	}
+}
+
+func (tx *sipClientTransaction) transition(state sipTransactionState) {
+	tx.sm.logger.Debug("%s transaction %s -> %s", tx.req.Method, tx.state, state)
+	tx.state = state
+}
+
+// run sends the request and drives the transaction until a final response
+// is received or the transaction times out.
+func (tx *sipClientTransaction) run() (*sip.Msg, error) {
+	var err error
+	tx.responses, err = tx.sm.dispatcher.register(tx.req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.sm.writeWebsocket(tx.req); err != nil {
+		tx.sm.dispatcher.unregister(tx.req)
+		return nil, fmt.Errorf("could not send %s over websocket: %w", tx.req.Method, err)
+	}
+
+	// Timer B for INVITE, Timer F otherwise
+	timeout := time.NewTimer(tx.timeoutAfter(sipTransactionTimeout))
+	defer timeout.Stop()
+
+	for {
+		select {
+		case resp, ok := <-tx.responses:
+			if !ok {
+				tx.transition(sipTransactionTerminated)
+				return nil, tx.sm.dispatcher.lastError()
+			}
+
+			if resp.Status < sip.StatusOK {
+				tx.sm.logger.Debug("Got provisional response %d %s to %s", resp.Status, resp.Phrase, tx.req.Method)
+				if tx.state == sipTransactionCalling {
+					tx.transition(sipTransactionProceeding)
+				}
+				if tx.invite {
+					// INVITEs may take a while to be answered once the
+					// remote is known to be working on them
+					resetTimer(timeout, tx.timeoutAfter(sipProceedingTimeout))
+				}
+				continue
+			}
+
+			if tx.invite && resp.Status < sip.StatusMultipleChoices {
+				// the ACK for a 2xx is the responsibility of the caller, and
+				// the remote retransmits the 2xx until it arrives
+				tx.transition(sipTransactionTerminated)
+				go tx.absorbRetransmissions(sip2xxRetransmitTimeout, func(resp *sip.Msg) {
+					tx.sm.sendAck(resp)
+				})
+				return resp, nil
+			}
+
+			tx.transition(sipTransactionCompleted)
+			if tx.invite {
+				if err := tx.sm.writeWebsocket(tx.makeAck(resp)); err != nil {
+					tx.sm.logger.Warn("Could not send ack for %d %s: %s", resp.Status, resp.Phrase, err)
+				}
+			}
+			// Timer D and Timer K
+			tx.transition(sipTransactionTerminated)
+			tx.sm.dispatcher.unregister(tx.req)
+			return resp, nil
+
+		case <-timeout.C:
+			tx.transition(sipTransactionTerminated)
+			tx.sm.dispatcher.unregister(tx.req)
+			return nil, fmt.Errorf("%s transaction timed out in state %s", tx.req.Method, tx.state)
+		}
+	}
+}
+
+// timeoutAfter returns d, shortened to end at the transaction's deadline.
+func (tx *sipClientTransaction) timeoutAfter(d time.Duration) time.Duration {
+	if tx.deadline.IsZero() {
+		return d
+	}
+	if untilDeadline := time.Until(tx.deadline); untilDeadline < d {
+		return untilDeadline
+	}
+	return d
+}
+
+// absorbRetransmissions keeps the transaction registered with the dispatcher
+// for the given duration, so retransmitted final responses are handled here
+// instead of being reported as unsolicited.
+func (tx *sipClientTransaction) absorbRetransmissions(d time.Duration, handler func(*sip.Msg)) {
+	defer tx.sm.dispatcher.unregister(tx.req)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case resp, ok := <-tx.responses:
+			if !ok {
+				return
+			}
+			if resp.Status < sip.StatusOK {
+				continue
+			}
+			tx.sm.logger.Debug("Absorbed retransmitted %d %s to %s", resp.Status, resp.Phrase, tx.req.Method)
+			if handler != nil {
+				handler(resp)
+			}
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// makeAck builds the ACK for a non-2xx final response to an INVITE,
+// which belongs to the INVITE's transaction (RFC 3261 section 17.1.1.3).
+func (tx *sipClientTransaction) makeAck(resp *sip.Msg) *sip.Msg {
+	return &sip.Msg{
+		CallID:             tx.req.CallID,
+		CSeq:               tx.req.CSeq,
+		Method:             sip.MethodAck,
+		CSeqMethod:         sip.MethodAck,
+		Request:            tx.req.Request.Copy(),
+		Route:              tx.req.Route,
+		Via:                tx.req.Via.Detach(),
+		From:               tx.req.From.Copy(),
+		To:                 resp.To.Copy(),
+		ProxyAuthorization: tx.req.ProxyAuthorization,
+		Supported:          "outbound",
+		UserAgent:          tx.sm.sipInfo.UserAgent,
+	}
+}
+
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	stopTimer(t)
+	t.Reset(d)
+}
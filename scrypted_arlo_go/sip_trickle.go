@@ -0,0 +1,268 @@
+package scrypted_arlo_go
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jart/gosip/sip"
+	"github.com/pion/webrtc/v3"
+
+	pionsdp "github.com/pion/sdp/v3"
+)
+
+// trickle ICE over SIP, see RFC 8840
+const (
+	sipTrickleContentType = "application/trickle-ice-sdpfrag"
+	sipTrickleInfoPackage = "trickle-ice"
+
+	// host candidates are gathered almost immediately, so the INVITE
+	// waits at most this long for them
+	sipTrickleHostWait = 500 * time.Millisecond
+)
+
+// waitForGathering waits for ICE gathering to finish, or for timeout if
+// non-zero, and reports whether gathering finished.
+func (sm *SIPWebRTCManager) waitForGathering(timeout Duration) bool {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-sm.webrtc.iceCompleteSentinel:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+// makeTrickleSDP creates an offer as soon as host candidates are known,
+// returning it along with the candidates it contains.
+func (sm *SIPWebRTCManager) makeTrickleSDP() (string, map[string]bool, error) {
+	offer, err := sm.webrtc.pc.CreateOffer(sipOfferOptions)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not create offer sdp: %w", err)
+	}
+	if err = sm.webrtc.SetLocalDescription(offer); err != nil {
+		return "", nil, fmt.Errorf("could not set local description: %w", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	candidates := sm.webrtc.candidateLog().subscribe(done)
+
+	timeout := time.NewTimer(sipTrickleHostWait)
+	defer timeout.Stop()
+gather:
+	for {
+		select {
+		case c, ok := <-candidates:
+			if !ok || c.Typ != webrtc.ICECandidateTypeHost {
+				break gather
+			}
+		case <-timeout.C:
+			break gather
+		}
+	}
+
+	localSDP := sm.webrtc.pc.LocalDescription().SDP
+	if !strings.Contains(localSDP, "a=ice-options:trickle") {
+		localSDP = strings.Replace(localSDP, "\r\nm=", "\r\na=ice-options:trickle\r\nm=", 1)
+	}
+	localSDP = sm.filterCandidates(localSDP)
+
+	sent := map[string]bool{}
+	for _, line := range strings.Split(localSDP, "\r\n") {
+		if strings.HasPrefix(line, "a=candidate:") {
+			sent[strings.TrimPrefix(line, "a=")] = true
+		}
+	}
+	return localSDP, sent, nil
+}
+
+// trickleCandidates sends candidates gathered after the INVITE to the
+// remote in INFO requests, until gathering finishes or the gathering
+// timeout passes. If the remote refuses them, the complete set of
+// candidates is offered by re-INVITE instead.
+func (sm *SIPWebRTCManager) trickleCandidates(sent map[string]bool) {
+	var deadline <-chan time.Time
+	if sm.sipInfo.ICEGatheringTimeout > 0 {
+		timer := time.NewTimer(sm.sipInfo.ICEGatheringTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	gathered := sm.webrtc.candidateLog().subscribe(done)
+
+	// candidates in the local description that haven't been sent yet
+	unsent := func() []string {
+		var candidates []string
+		for _, line := range strings.Split(sm.filterCandidates(sm.webrtc.pc.LocalDescription().SDP), "\r\n") {
+			candidate := strings.TrimPrefix(line, "a=")
+			if strings.HasPrefix(candidate, "candidate:") && !sent[candidate] {
+				candidates = append(candidates, candidate)
+			}
+		}
+		return candidates
+	}
+
+	for {
+		var candidates []string
+		end := false
+
+		select {
+		case <-sm.closed:
+			return
+		case c, ok := <-gathered:
+			if !ok {
+				candidates = unsent()
+				end = true
+				break
+			}
+			// the candidate policy has already been applied
+			candidate := c.ToJSON().Candidate
+			if sent[candidate] {
+				continue
+			}
+			candidates = []string{candidate}
+		case <-deadline:
+			sm.logger.Info("ICE gathering deadline passed, not sending further candidates")
+			end = true
+		}
+
+		if err := sm.sendTrickleInfo(candidates, end); err != nil {
+			sm.logger.Warn("Could not trickle ICE candidates, falling back to re-INVITE: %s", err)
+			sm.offerAllCandidates()
+			return
+		}
+		for _, candidate := range candidates {
+			sent[candidate] = true
+		}
+		if end {
+			return
+		}
+	}
+}
+
+// offerAllCandidates waits for gathering and sends an offer with every
+// candidate by re-INVITE, for remotes that don't support trickle ICE.
+func (sm *SIPWebRTCManager) offerAllCandidates() {
+	sm.waitForGathering(sm.sipInfo.ICEGatheringTimeout)
+
+	offer, err := sm.webrtc.pc.CreateOffer(sipOfferOptions)
+	if err != nil {
+		sm.logger.Warn("Could not create offer sdp: %s", err)
+		return
+	}
+	if err = sm.webrtc.SetLocalDescription(offer); err != nil {
+		sm.logger.Warn("Could not set local description: %s", err)
+		return
+	}
+	if err = sm.reinvite(sm.webrtc.pc.LocalDescription().SDP); err != nil {
+		sm.logger.Warn("Could not offer all ICE candidates: %s", err)
+	}
+}
+
+func (sm *SIPWebRTCManager) sendTrickleInfo(candidates []string, end bool) error {
+	frag, err := trickleSDPFrag(sm.webrtc.pc.LocalDescription().SDP, candidates, end)
+	if err != nil {
+		return err
+	}
+
+	sm.inviteRespMsgLock.Lock()
+	if sm.inviteResp == nil {
+		sm.inviteRespMsgLock.Unlock()
+		return fmt.Errorf("no call in progress")
+	}
+	info := sm.makeDialogRequest(sip.MethodInfo)
+	sm.inviteRespMsgLock.Unlock()
+
+	info.ContentDisposition = "Info-Package"
+	info.XHeader = &sip.XHeader{
+		Name:  "Info-Package",
+		Value: []byte(sipTrickleInfoPackage),
+	}
+	info.Payload = &sip.MiscPayload{
+		T: sipTrickleContentType,
+		D: []byte(frag),
+	}
+
+	resp, err := sm.request(info)
+	if err != nil {
+		return fmt.Errorf("could not read INFO response: %w", err)
+	}
+	return sm.verify200OK(resp)
+}
+
+// trickleSDPFrag builds an application/trickle-ice-sdpfrag body carrying
+// candidates for the first media section of localSDP, which all media is
+// bundled on.
+func trickleSDPFrag(localSDP string, candidates []string, end bool) (string, error) {
+	var desc pionsdp.SessionDescription
+	if err := desc.Unmarshal([]byte(localSDP)); err != nil {
+		return "", fmt.Errorf("could not parse local sdp: %w", err)
+	}
+	if len(desc.MediaDescriptions) == 0 {
+		return "", fmt.Errorf("local sdp has no media")
+	}
+	media := desc.MediaDescriptions[0]
+
+	attribute := func(key string) string {
+		if value, ok := media.Attribute(key); ok {
+			return value
+		}
+		for _, a := range desc.Attributes {
+			if a.Key == key {
+				return a.Value
+			}
+		}
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "a=ice-ufrag:%s\r\n", attribute("ice-ufrag"))
+	fmt.Fprintf(&b, "a=ice-pwd:%s\r\n", attribute("ice-pwd"))
+	fmt.Fprintf(&b, "m=%s 9 %s %s\r\n", media.MediaName.Media,
+		strings.Join(media.MediaName.Protos, "/"), strings.Join(media.MediaName.Formats, " "))
+	if mid := attribute("mid"); mid != "" {
+		fmt.Fprintf(&b, "a=mid:%s\r\n", mid)
+	}
+	for _, candidate := range candidates {
+		fmt.Fprintf(&b, "a=%s\r\n", candidate)
+	}
+	if end {
+		b.WriteString("a=end-of-candidates\r\n")
+	}
+	return b.String(), nil
+}
+
+// handleTrickleInfo applies candidates trickled by the remote.
+func (sm *SIPWebRTCManager) handleTrickleInfo(req *sip.Msg) {
+	if sm.sipInfo.SDP != "" {
+		// media is handled by the caller
+		return
+	}
+
+	var mid *string
+	for _, line := range strings.Split(string(req.Payload.Data()), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			err := sm.webrtc.AddICECandidate(WebRTCICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    mid,
+			})
+			if err != nil {
+				sm.logger.Warn("Could not add remote ICE candidate: %s", err)
+			}
+		}
+	}
+}
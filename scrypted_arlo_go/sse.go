@@ -5,40 +5,266 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/tmaxmax/go-sse"
 )
 
+const (
+	sseDefaultBackoffInitial = 1 * time.Second
+	sseDefaultBackoffMax     = 2 * time.Minute
+)
+
+// connection statuses reported by SSEClient.GetStatus
+const (
+	SSEStatusConnecting   = "connecting"
+	SSEStatusConnected    = "connected"
+	SSEStatusStale        = "stale"
+	SSEStatusReconnecting = "reconnecting"
+	SSEStatusClosed       = "closed"
+)
+
+// sseActivityBody reports every successful read of a response body, which
+// includes heartbeat comments that go-sse doesn't surface as events.
+type sseActivityBody struct {
+	io.ReadCloser
+	touch func()
+}
+
+func (b *sseActivityBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.touch()
+	}
+	return n, err
+}
+
+type sseActivityTransport struct {
+	base  http.RoundTripper
+	touch func()
+}
+
+func (t *sseActivityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &sseActivityBody{ReadCloser: resp.Body, touch: t.touch}
+	return resp, nil
+}
+
 type SSEClient struct {
 	UUID string
 
 	url     string
 	headers HeadersMap
+	logger  *Logger
+
+	// every event is published to all subscriptions. Next and
+	// NextFiltered read from a default subscription
+	subscriptions     map[string]*SSESubscription
+	subscriptionsLock *sync.Mutex
+	defaultSub        *SSESubscription
+
+	// delay before the first reconnection attempt, doubling on every
+	// consecutive failure up to backoffMax
+	backoffInitial Duration
+	backoffMax     Duration
 
-	messages chan sse.Event
+	// reconnect if nothing at all arrives for this long, 0 to disable
+	idleTimeout Duration
+
+	statusCallback func(status string)
 
 	ctxLock *sync.Mutex
 	ctx     context.Context
 	conn    *sse.Connection
 	cancel  context.CancelFunc
+
+	closeOnce *sync.Once
+	closed    chan struct{}
+
+	// closed once Start gives up, after which no more events arrive
+	finished chan struct{}
+
+	// connection state reported to callers
+	stateLock   *sync.Mutex
+	lastEventID string
+	reconnects  int
+	failures    int
+	lastError   error
+
+	status       string
+	lastActivity time.Time
+	idleTimedOut bool
 }
 
+// NewSSEClient creates a client with a default subscription, which Next,
+// NextFiltered and the client's filter methods read from. Like any other
+// non-blocking subscription, it drops events while its buffer is full, see
+// GetDroppedCount. Callers that only use Subscribe should create the client
+// with NewSSEClientWithoutDefaultSubscription instead.
 func NewSSEClient(url string, headers HeadersMap) (*SSEClient, error) {
+	return newSSEClient(url, headers, true)
+}
+
+// NewSSEClientWithoutDefaultSubscription creates a client whose events are
+// only delivered through Subscribe. Next returns io.EOF.
+func NewSSEClientWithoutDefaultSubscription(url string, headers HeadersMap) (*SSEClient, error) {
+	return newSSEClient(url, headers, false)
+}
+
+func newSSEClient(url string, headers HeadersMap, defaultSubscription bool) (*SSEClient, error) {
 	s := &SSEClient{
-		UUID:     uuid.New().String(),
-		url:      url,
-		headers:  headers,
-		messages: make(chan sse.Event),
-		ctxLock:  &sync.Mutex{},
+		UUID:              uuid.New().String(),
+		url:               url,
+		headers:           headers,
+		logger:            newStdoutLogger("SSEClient"),
+		subscriptions:     map[string]*SSESubscription{},
+		subscriptionsLock: &sync.Mutex{},
+		backoffInitial:    sseDefaultBackoffInitial,
+		backoffMax:        sseDefaultBackoffMax,
+		ctxLock:           &sync.Mutex{},
+		closeOnce:         &sync.Once{},
+		closed:            make(chan struct{}),
+		finished:          make(chan struct{}),
+		stateLock:         &sync.Mutex{},
+		status:            SSEStatusConnecting,
 	}
+	// the default subscription drops rather than blocks, so that a caller
+	// not reading Next can't stall the stream for every other subscription
+	// and trip the idle timeout
+	s.defaultSub = s.Subscribe(sseDefaultSubscriptionBuffer, false)
+	if !defaultSubscription {
+		s.defaultSub.Unsubscribe()
+	}
+	s.logger.SetField(LogFieldSession, s.UUID)
+
 	s.ctxLock.Lock()
 	defer s.ctxLock.Unlock()
 	return s, s.initialize()
 }
 
+// SetLogger sends the client's logs to l instead of stdout. Must be called
+// before Start.
+func (s *SSEClient) SetLogger(l *Logger) {
+	s.logger = l.With(LogFieldSession, s.UUID)
+}
+
+// GetLogger returns the client's logger, e.g. to set the device ID field,
+// the level or the output format.
+func (s *SSEClient) GetLogger() *Logger {
+	return s.logger
+}
+
+// SetBackoff configures the delay between reconnection attempts. The delay
+// starts at initial and doubles after each consecutive failure, up to max,
+// with random jitter so that many clients don't reconnect in lockstep.
+// Must be called before Start.
+func (s *SSEClient) SetBackoff(initial, max Duration) {
+	if initial > 0 {
+		s.backoffInitial = initial
+	}
+	if max > 0 {
+		s.backoffMax = max
+	}
+}
+
+// SetIdleTimeout makes the client reconnect when no data, not even a
+// heartbeat comment, arrives for timeout. The connection is reported as
+// stale when this happens. 0 disables the check, which is the default.
+// Must be called before Start.
+func (s *SSEClient) SetIdleTimeout(timeout Duration) {
+	s.idleTimeout = timeout
+}
+
+// SetStatusCallback registers a function called with the new status
+// whenever the connection status changes, e.g. to warn that cloud events
+// are stale. Must be called before Start.
+func (s *SSEClient) SetStatusCallback(callback func(status string)) {
+	s.statusCallback = callback
+}
+
+// GetStatus returns one of the SSEStatus constants.
+func (s *SSEClient) GetStatus() string {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.status
+}
+
+// GetIdleSeconds returns how long it has been since any data arrived.
+func (s *SSEClient) GetIdleSeconds() float64 {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	if s.lastActivity.IsZero() {
+		return 0
+	}
+	return time.Since(s.lastActivity).Seconds()
+}
+
+func (s *SSEClient) setStatus(status string) {
+	s.stateLock.Lock()
+	changed := s.status != status && s.status != SSEStatusClosed
+	if changed {
+		s.status = status
+	}
+	s.stateLock.Unlock()
+
+	if changed {
+		s.logger.Info("Status is %s", status)
+		if s.statusCallback != nil {
+			s.statusCallback(status)
+		}
+	}
+}
+
+func (s *SSEClient) touch() {
+	s.stateLock.Lock()
+	s.lastActivity = time.Now()
+	connected := s.status == SSEStatusConnected
+	s.stateLock.Unlock()
+
+	if !connected {
+		s.setStatus(SSEStatusConnected)
+	}
+}
+
+// watchIdle cancels the connection if it goes quiet for longer than the
+// idle timeout, which makes Start reconnect.
+func (s *SSEClient) watchIdle(ctx context.Context, cancel context.CancelFunc) {
+	interval := s.idleTimeout / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.stateLock.Lock()
+		idle := time.Since(s.lastActivity) > s.idleTimeout
+		if idle {
+			s.idleTimedOut = true
+		}
+		s.stateLock.Unlock()
+
+		if idle {
+			s.setStatus(SSEStatusStale)
+			cancel()
+			return
+		}
+	}
+}
+
 // must hold ctxLock when calling this
 func (s *SSEClient) initialize() error {
 	s.ctx, s.cancel = context.WithCancel(context.Background())
@@ -49,50 +275,181 @@ func (s *SSEClient) initialize() error {
 	}
 
 	req.Header = s.headers.toHTTPHeaders()
-	s.conn = sse.NewConnection(req)
+	if lastEventID := s.GetLastEventID(); lastEventID != "" {
+		// resume from where the previous connection left off
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	// reconnections are handled by Start, so that the backoff and
+	// Last-Event-ID are under our control
+	client := &sse.Client{
+		HTTPClient: &http.Client{
+			Transport: &sseActivityTransport{base: http.DefaultTransport, touch: s.touch},
+		},
+		Backoff: sse.Backoff{MaxRetries: -1},
+	}
+	ctx := s.ctx
+	s.conn = client.NewConnection(req)
 	s.conn.SubscribeToAll(func(event sse.Event) {
-		s.ctxLock.Lock()
-		defer s.ctxLock.Unlock()
-		if s.ctx.Err() != context.Canceled {
-			s.messages <- event
+		s.stateLock.Lock()
+		if event.LastEventID != "" {
+			s.lastEventID = event.LastEventID
+		}
+		s.failures = 0
+		s.stateLock.Unlock()
+
+		if event.Data == "" {
+			// heartbeat comments surface as empty events, but per the
+			// SSE spec events without data aren't dispatched
+			return
+		}
+
+		if ctx.Err() == nil {
+			s.publish(ctx, event)
 		}
 	})
 
 	return nil
 }
 
+// nextBackoff returns how long to wait before the next reconnection
+// attempt, counting the failure that just happened.
+func (s *SSEClient) nextBackoff() time.Duration {
+	s.stateLock.Lock()
+	failures := s.failures
+	s.failures++
+	s.stateLock.Unlock()
+
+	return jitteredBackoff(s.backoffInitial, s.backoffMax, failures)
+}
+
+// jitteredBackoff returns the delay before a reconnection attempt after
+// the given number of consecutive failures: initial doubled per failure
+// up to max, randomized so that many clients don't reconnect in lockstep.
+func jitteredBackoff(initial, max time.Duration, failures int) time.Duration {
+	delay := initial
+	for i := 0; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	// wait somewhere between half and all of the delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
 func (s *SSEClient) Start() {
 	go func() {
+		defer close(s.finished)
+
+		s.logger.Info("Starting")
 		for {
-			fmt.Printf("[Arlo]: SSEClient %s starting\n", s.UUID)
-			err := s.conn.Connect()
 			s.ctxLock.Lock()
-			if errors.Is(err, context.Canceled) || s.ctx.Err() == context.Canceled {
-				fmt.Printf("[Arlo]: SSEClient %s exited\n", s.UUID)
+			conn, ctx, cancel := s.conn, s.ctx, s.cancel
+			s.ctxLock.Unlock()
+
+			s.stateLock.Lock()
+			s.lastActivity = time.Now()
+			s.idleTimedOut = false
+			s.stateLock.Unlock()
+			if s.idleTimeout > 0 {
+				go s.watchIdle(ctx, cancel)
+			}
+
+			err := conn.Connect()
+			cancel()
+
+			select {
+			case <-s.closed:
+				s.logger.Info("Exited")
+				return
+			default:
+			}
+
+			s.stateLock.Lock()
+			if s.idleTimedOut {
+				err = fmt.Errorf("no data received for %s", s.idleTimeout)
+			} else if err == nil || errors.Is(err, context.Canceled) {
+				err = io.EOF
+			}
+			s.lastError = err
+			s.reconnects++
+			s.stateLock.Unlock()
+			s.setStatus(SSEStatusReconnecting)
+
+			delay := s.nextBackoff()
+			s.logger.Warn("Restarting in %s due to: %v", delay.Round(time.Millisecond), err)
+
+			select {
+			case <-s.closed:
+				s.logger.Info("Exited")
+				return
+			case <-time.After(delay):
+			}
+
+			s.setStatus(SSEStatusConnecting)
+			s.ctxLock.Lock()
+			select {
+			case <-s.closed:
+				// closed while we were waiting
+				s.logger.Info("Exited")
 				s.ctxLock.Unlock()
-				break
+				return
+			default:
 			}
-			fmt.Printf("[Arlo]: SSEClient %s restarting due to: %v\n", s.UUID, err)
 			if err := s.initialize(); err != nil {
-				fmt.Printf("[Arlo]: SSEClient %s could not be reinitialized: %v\n", s.UUID, err)
+				s.logger.Error("Could not reinitialize: %v", err)
 				s.ctxLock.Unlock()
-				break
+				return
 			}
 			s.ctxLock.Unlock()
 		}
-		close(s.messages)
 	}()
 }
 
 func (s *SSEClient) Next() (string, error) {
-	event, ok := <-s.messages
-	if !ok {
-		return "", io.EOF
+	return s.defaultSub.Next()
+}
+
+// GetDroppedCount returns how many events the default subscription
+// dropped because Next wasn't called often enough.
+func (s *SSEClient) GetDroppedCount() int {
+	return s.defaultSub.GetDroppedCount()
+}
+
+// GetLastEventID returns the ID of the most recent event that carried one,
+// which is sent as Last-Event-ID when reconnecting.
+func (s *SSEClient) GetLastEventID() string {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.lastEventID
+}
+
+// GetReconnectCount returns how many times the connection has been lost
+// and reattempted.
+func (s *SSEClient) GetReconnectCount() int {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.reconnects
+}
+
+// GetLastError returns the error that caused the most recent reconnection,
+// or an empty string if there hasn't been one.
+func (s *SSEClient) GetLastError() string {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	if s.lastError == nil {
+		return ""
 	}
-	return event.Data, nil
+	return s.lastError.Error()
 }
 
 func (s *SSEClient) Close() {
+	s.closeOnce.Do(func() {
+		s.setStatus(SSEStatusClosed)
+		close(s.closed)
+	})
 	s.ctxLock.Lock()
 	defer s.ctxLock.Unlock()
 	s.cancel()
@@ -0,0 +1,157 @@
+package scrypted_arlo_go
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ArloEvent is a decoded Arlo event-stream payload.
+type ArloEvent struct {
+	Resource string
+	Action   string
+	From     string
+	TransID  string
+
+	// the properties object, left as JSON since its shape depends on
+	// the resource
+	Properties string
+
+	// the payload exactly as received
+	Raw string
+}
+
+type arloEventJSON struct {
+	Resource   string          `json:"resource"`
+	Action     string          `json:"action"`
+	From       string          `json:"from"`
+	TransID    string          `json:"transId"`
+	Properties json.RawMessage `json:"properties"`
+}
+
+// DecodeArloEvent parses an Arlo event-stream payload.
+func DecodeArloEvent(data string) (*ArloEvent, error) {
+	var raw arloEventJSON
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, fmt.Errorf("could not decode event: %w", err)
+	}
+
+	return &ArloEvent{
+		Resource:   raw.Resource,
+		Action:     raw.Action,
+		From:       raw.From,
+		TransID:    raw.TransID,
+		Properties: string(raw.Properties),
+		Raw:        data,
+	}, nil
+}
+
+// hasDevice reports whether the event was sent by or is about deviceID.
+func (e *ArloEvent) hasDevice(deviceID string) bool {
+	if e.From == deviceID {
+		return true
+	}
+	for _, part := range strings.Split(e.Resource, "/") {
+		if part == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// arloEventFilter selects events by resource prefix or device ID. Events
+// matching any rule pass; with no rules, every event does.
+type arloEventFilter struct {
+	lock      *sync.Mutex
+	resources []string
+	devices   []string
+}
+
+func newArloEventFilter() *arloEventFilter {
+	return &arloEventFilter{lock: &sync.Mutex{}}
+}
+
+func (f *arloEventFilter) addResource(prefix string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.resources = append(f.resources, prefix)
+}
+
+func (f *arloEventFilter) addDevice(deviceID string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.devices = append(f.devices, deviceID)
+}
+
+func (f *arloEventFilter) clear() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.resources = nil
+	f.devices = nil
+}
+
+func (f *arloEventFilter) matches(event *ArloEvent) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(f.resources) == 0 && len(f.devices) == 0 {
+		return true
+	}
+	for _, prefix := range f.resources {
+		if strings.HasPrefix(event.Resource, prefix) {
+			return true
+		}
+	}
+	for _, deviceID := range f.devices {
+		if event.hasDevice(deviceID) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextFilteredEvent reads from next until an Arlo event passing filter
+// arrives. Payloads that aren't Arlo events, such as the initial
+// connection status message, are skipped.
+func nextFilteredEvent(next func() (string, error), filter *arloEventFilter) (*ArloEvent, error) {
+	for {
+		data, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		decoded, err := DecodeArloEvent(data)
+		if err != nil || decoded.Resource == "" {
+			continue
+		}
+		if filter.matches(decoded) {
+			return decoded, nil
+		}
+	}
+}
+
+// AddResourceFilter makes NextFiltered return events whose resource starts
+// with prefix. See SSESubscription.AddResourceFilter.
+func (s *SSEClient) AddResourceFilter(prefix string) {
+	s.defaultSub.AddResourceFilter(prefix)
+}
+
+// AddDeviceFilter makes NextFiltered return events sent by or about the
+// device with the given ID.
+func (s *SSEClient) AddDeviceFilter(deviceID string) {
+	s.defaultSub.AddDeviceFilter(deviceID)
+}
+
+// ClearFilters removes all filters added with AddResourceFilter and
+// AddDeviceFilter.
+func (s *SSEClient) ClearFilters() {
+	s.defaultSub.ClearFilters()
+}
+
+// NextFiltered blocks until an event matching the filters arrives and
+// returns it decoded. It consumes from the same queue as Next, so the two
+// shouldn't be used on the same client.
+func (s *SSEClient) NextFiltered() (*ArloEvent, error) {
+	return s.defaultSub.NextFiltered()
+}
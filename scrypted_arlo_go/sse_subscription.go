@@ -0,0 +1,179 @@
+package scrypted_arlo_go
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/tmaxmax/go-sse"
+)
+
+// buffer size of the subscription backing SSEClient.Next
+const sseDefaultSubscriptionBuffer = 64
+
+// SSESubscription is one consumer of an SSEClient's events. Each
+// subscription has its own buffer, so a slow consumer only affects
+// itself unless it asked to block the stream when full.
+type SSESubscription struct {
+	ID string
+
+	client   *SSEClient
+	messages chan sse.Event
+
+	// whether delivery waits for room in the buffer instead of dropping
+	block bool
+
+	unsubscribeOnce *sync.Once
+	unsubscribed    chan struct{}
+
+	// see NextFiltered
+	filter *arloEventFilter
+
+	lock    *sync.Mutex
+	dropped int
+}
+
+// Subscribe registers a new consumer of events with room for bufferSize
+// undelivered events. When the buffer is full, new events are dropped
+// for this subscription, or if blockWhenFull is set, the stream is paused
+// until the subscriber catches up. A paused stream counts as idle, so a
+// blocking subscriber that stalls for longer than the idle timeout causes
+// a reconnection.
+func (s *SSEClient) Subscribe(bufferSize int, blockWhenFull bool) *SSESubscription {
+	if bufferSize < 0 {
+		bufferSize = 0
+	}
+	sub := &SSESubscription{
+		ID:              uuid.New().String(),
+		client:          s,
+		messages:        make(chan sse.Event, bufferSize),
+		block:           blockWhenFull,
+		unsubscribeOnce: &sync.Once{},
+		unsubscribed:    make(chan struct{}),
+		filter:          newArloEventFilter(),
+		lock:            &sync.Mutex{},
+	}
+
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+	s.subscriptions[sub.ID] = sub
+	return sub
+}
+
+// publish hands event, received on the connection with context ctx, to
+// every subscription.
+func (s *SSEClient) publish(ctx context.Context, event sse.Event) {
+	s.subscriptionsLock.Lock()
+	subs := make([]*SSESubscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		subs = append(subs, sub)
+	}
+	s.subscriptionsLock.Unlock()
+
+	for _, sub := range subs {
+		sub.deliver(ctx, event)
+	}
+}
+
+// deliver waits for room in a blocking subscription until the subscription
+// or client is finished, or the connection is torn down, e.g. by the idle
+// timeout.
+func (sub *SSESubscription) deliver(ctx context.Context, event sse.Event) {
+	if sub.block {
+		select {
+		case sub.messages <- event:
+		case <-sub.unsubscribed:
+		case <-sub.client.closed:
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	select {
+	case sub.messages <- event:
+	default:
+		sub.lock.Lock()
+		sub.dropped++
+		sub.lock.Unlock()
+	}
+}
+
+// next returns the next buffered event, or false once the subscription or
+// client is finished and the buffer is drained.
+func (sub *SSESubscription) next() (sse.Event, bool) {
+	// prefer buffered events, so that nothing is lost when the stream ends
+	select {
+	case event := <-sub.messages:
+		return event, true
+	default:
+	}
+
+	select {
+	case event := <-sub.messages:
+		return event, true
+	case <-sub.unsubscribed:
+		return sse.Event{}, false
+	case <-sub.client.finished:
+		select {
+		case event := <-sub.messages:
+			return event, true
+		default:
+			return sse.Event{}, false
+		}
+	}
+}
+
+// Next blocks until an event arrives and returns its raw data.
+func (sub *SSESubscription) Next() (string, error) {
+	event, ok := sub.next()
+	if !ok {
+		return "", io.EOF
+	}
+	return event.Data, nil
+}
+
+// NextFiltered blocks until an event matching the subscription's filters
+// arrives and returns it decoded. Payloads that aren't Arlo events, such
+// as the initial connection status message, are skipped.
+func (sub *SSESubscription) NextFiltered() (*ArloEvent, error) {
+	return nextFilteredEvent(sub.Next, sub.filter)
+}
+
+// AddResourceFilter makes NextFiltered return events whose resource starts
+// with prefix, e.g. "cameras/" or "modes". Events matching any filter are
+// returned; with no filters, every event is.
+func (sub *SSESubscription) AddResourceFilter(prefix string) {
+	sub.filter.addResource(prefix)
+}
+
+// AddDeviceFilter makes NextFiltered return events sent by or about the
+// device with the given ID.
+func (sub *SSESubscription) AddDeviceFilter(deviceID string) {
+	sub.filter.addDevice(deviceID)
+}
+
+// ClearFilters removes all filters added with AddResourceFilter and
+// AddDeviceFilter.
+func (sub *SSESubscription) ClearFilters() {
+	sub.filter.clear()
+}
+
+// GetDroppedCount returns how many events were dropped because the
+// subscription's buffer was full.
+func (sub *SSESubscription) GetDroppedCount() int {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return sub.dropped
+}
+
+// Unsubscribe stops delivery to this subscription. Once any buffered
+// events have been consumed, Next returns io.EOF.
+func (sub *SSESubscription) Unsubscribe() {
+	sub.unsubscribeOnce.Do(func() {
+		sub.client.subscriptionsLock.Lock()
+		delete(sub.client.subscriptions, sub.ID)
+		sub.client.subscriptionsLock.Unlock()
+		close(sub.unsubscribed)
+	})
+}
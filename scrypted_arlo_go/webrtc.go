@@ -4,15 +4,20 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/pion/ice/v2"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/logging"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 	"golang.org/x/exp/slices"
@@ -26,6 +31,9 @@ var DEBUG = !slices.Contains([]string{"", "0"}, os.Getenv("SCRYPTED_ARLO_GO_DEBU
 
 var UDP_PACKET_SIZE = 1200
 
+// video RTP from ffmpeg and the like fills an ethernet MTU
+const videoRTPPacketSize = 1500
+
 // type aliases for gopy to detect these structs
 type WebRTCICEServer = webrtc.ICEServer
 type WebRTCSessionDescription = webrtc.SessionDescription
@@ -57,45 +65,111 @@ const (
 )
 
 type WebRTCManager struct {
-	pc          *webrtc.PeerConnection
-	infoLogger  *TCPLogger
-	debugLogger *TCPLogger
-	name        string
+	pc     *webrtc.PeerConnection
+	logger *Logger
+	name   string
 
-	// for receiving audio RTP packets
+	// for receiving audio and video RTP packets
 	audioRTP net.Conn
+	videoRTP net.Conn
+
+	// for encoding raw audio, instead of receiving audio RTP packets
+	audioPCM     *pcmEncoder
+	audioPCMLock *sync.Mutex
+
+	// for sending remote RTP packets to local consumers
+	forwarders     map[webrtc.RTPCodecType]*rtpForwarder
+	forwardersLock *sync.Mutex
+
+	// remote video tracks, for requesting keyframes
+	remoteVideoSSRCs []uint32
+	firSequence      uint8
+
+	// streams reported by GetStats
+	statsGetter  stats.Getter
+	localTracks  map[webrtc.RTPCodecType]*statsTrack
+	remoteTracks map[webrtc.RTPCodecType]*statsTrack
+	statsLock    *sync.Mutex
 
 	// used to signal completion of ice gathering
-	// cache results in iceCandidates
+	// cache results in iceCandidates, which is replaced by a fresh log for
+	// every ICE restart
 	iceCompleteSentinel <-chan struct{}
-	iceCandidates       chan WebRTCICECandidate
+	iceCandidates       *iceCandidateLog
+	iceCandidatesLock   *sync.Mutex
+
+	// how many candidates of iceCandidatesReadLog GetNextICECandidate has
+	// returned
+	iceCandidatesRead     int
+	iceCandidatesReadLog  *iceCandidateLog
+	iceCandidatesReadLock *sync.Mutex
+
+	// decides which local candidates are gathered and signalled
+	candidatePolicy *ICECandidatePolicy
+
+	// set if WebRTCOptions.UDPMuxPort is used
+	udpMux *ice.MultiUDPMuxDefault
 
 	// for gathering startup metrics
 	startTime time.Time
+
+	// recovery from a lost connection, see EnableRecovery. recovered is
+	// set while recovering and closed once the connection is back
+	recoveryGrace Duration
+	restartICE    func(offerSDP string, deadline time.Time) error
+	recovered     chan struct{}
+	state         string
+	stateCallback func(state string)
+	recoveryLock  *sync.Mutex
+
+	// tears down the session once the connection is lost for good
+	closeFunc func()
 }
 
 func NewWebRTCManager(infoLoggerPort, debugLoggerPort int, iceServers []WebRTCICEServer) (*WebRTCManager, error) {
-	return newWebRTCManager(infoLoggerPort, debugLoggerPort, iceServers, "WebRTCManager")
+	return NewWebRTCManagerWithOptions(infoLoggerPort, debugLoggerPort, iceServers, nil)
 }
 
-func newWebRTCManager(infoLoggerPort, debugLoggerPort int, iceServers []WebRTCICEServer, name string) (*WebRTCManager, error) {
-	infoLogger, err := NewTCPLogger(infoLoggerPort, name)
+// NewWebRTCManagerWithOptions creates a WebRTCManager configured by
+// options, which may be nil to use the defaults.
+func NewWebRTCManagerWithOptions(infoLoggerPort, debugLoggerPort int, iceServers []WebRTCICEServer, options *WebRTCOptions) (*WebRTCManager, error) {
+	return newWebRTCManager(infoLoggerPort, debugLoggerPort, iceServers, options, "WebRTCManager")
+}
+
+func newWebRTCManager(infoLoggerPort, debugLoggerPort int, iceServers []WebRTCICEServer, options *WebRTCOptions, name string) (*WebRTCManager, error) {
+	if options == nil {
+		options = NewWebRTCOptions()
+	}
+	candidatePolicy, err := options.CandidatePolicy.compile()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid ICE candidate policy: %w", err)
 	}
-	debugLogger, err := NewTCPLogger(debugLoggerPort, name)
+
+	logger, err := NewLogger(infoLoggerPort, debugLoggerPort, name)
 	if err != nil {
 		return nil, err
 	}
+	logger.SetField(LogFieldSession, randString(8))
 
 	mgr := WebRTCManager{
-		infoLogger:    infoLogger,
-		debugLogger:   debugLogger,
-		name:          name,
-		startTime:     time.Now(),
-		iceCandidates: make(chan WebRTCICECandidate),
+		logger:                logger,
+		name:                  name,
+		startTime:             time.Now(),
+		iceCandidates:         newICECandidateLog(),
+		iceCandidatesLock:     &sync.Mutex{},
+		iceCandidatesReadLock: &sync.Mutex{},
+		candidatePolicy:       candidatePolicy,
+		forwarders:            map[webrtc.RTPCodecType]*rtpForwarder{},
+		forwardersLock:        &sync.Mutex{},
+		audioPCMLock:          &sync.Mutex{},
+		localTracks:           map[webrtc.RTPCodecType]*statsTrack{},
+		remoteTracks:          map[webrtc.RTPCodecType]*statsTrack{},
+		statsLock:             &sync.Mutex{},
+		state:                 WebRTCStateNew,
+		recoveryLock:          &sync.Mutex{},
 	}
-	mgr.Info("Library version %s built at %s", version, parsedBuildTime.String())
+	mgr.closeFunc = mgr.Close
+	mgr.logger.Info("Library version %s built at %s", version, parsedBuildTime.String())
 
 	certificates := []webrtc.Certificate{}
 
@@ -123,12 +197,19 @@ func newWebRTCManager(infoLoggerPort, debugLoggerPort int, iceServers []WebRTCIC
 	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
 		return nil, err
 	}
+	if err := mgr.registerStatsInterceptor(i); err != nil {
+		return nil, err
+	}
 
 	webrtcLogger := logging.NewDefaultLoggerFactory()
-	webrtcLogger.Writer = debugLogger
+	webrtcLogger.Writer = debugWriter{logger}
 	s := webrtc.SettingEngine{
 		LoggerFactory: webrtcLogger,
 	}
+	mgr.udpMux, err = options.applyTo(&s, candidatePolicy, webrtcLogger)
+	if err != nil {
+		return nil, err
+	}
 
 	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(s))
 	mgr.pc, err = api.NewPeerConnection(webrtc.Configuration{
@@ -140,37 +221,67 @@ func newWebRTCManager(infoLoggerPort, debugLoggerPort int, iceServers []WebRTCIC
 		Certificates:         certificates,
 	})
 	if err != nil {
+		if mgr.udpMux != nil {
+			mgr.udpMux.Close()
+		}
 		return nil, err
 	}
 	mgr.iceCompleteSentinel = webrtc.GatheringCompletePromise(mgr.pc)
 	mgr.pc.OnICECandidate(func(c *WebRTCICECandidate) {
-		if c != nil {
-			go func(c WebRTCICECandidate) { mgr.iceCandidates <- c }(*c)
+		if c == nil {
+			mgr.candidateLog().finish()
+			return
 		}
-	})
-	mgr.pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		mgr.Debug("OnConnectionStateChange %s", s.String())
-		if s == webrtc.PeerConnectionStateDisconnected {
-			mgr.Close()
-		} else if s == webrtc.PeerConnectionStateConnected {
-			mgr.PrintTimeSinceCreation()
+		if !mgr.candidatePolicy.allowsCandidate(c.Typ.String(), c.Address) {
+			mgr.logger.Debug("Filtered out candidate: %s", c.String())
+			return
 		}
+		mgr.candidateLog().add(*c)
 	})
+	mgr.pc.OnConnectionStateChange(mgr.onConnectionStateChange)
 	mgr.pc.OnICEConnectionStateChange(func(is webrtc.ICEConnectionState) {
-		mgr.Debug("OnICEConnectionStateChange %s", is.String())
+		mgr.logger.Debug("OnICEConnectionStateChange %s", is.String())
 		if is == webrtc.ICEConnectionStateConnected {
 			mgr.PrintTimeSinceCreation()
 		}
 	})
 	mgr.pc.OnTrack(func(tr *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
-		mgr.Debug("Remote sent us a track we will ignore: %s", tr.Codec().MimeType)
-		// we don't expect any useful audio to come back over the channel,
-		// so just read it and move on
+		mgr.logger.Debug("Remote sent us a %s track: %s", tr.Kind(), tr.Codec().MimeType)
+		st := newStatsTrack(uint32(tr.SSRC()), tr.Codec().ClockRate)
+		mgr.statsLock.Lock()
+		mgr.remoteTracks[tr.Kind()] = st
+		mgr.statsLock.Unlock()
+		if tr.Kind() == webrtc.RTPCodecTypeVideo {
+			mgr.forwardersLock.Lock()
+			mgr.remoteVideoSSRCs = append(mgr.remoteVideoSSRCs, uint32(tr.SSRC()))
+			hasForwarder := mgr.forwarders[webrtc.RTPCodecTypeVideo] != nil
+			mgr.forwardersLock.Unlock()
+
+			// get the consumer a decodable picture as soon as possible
+			if hasForwarder {
+				if err := mgr.RequestKeyframe(); err != nil {
+					mgr.logger.Warn("Could not request keyframe: %s", err)
+				}
+			}
+		}
+		// tracks must always be read so interceptors can do their work, even
+		// if nobody has asked for the media. packets are forwarded if there
+		// is a local consumer and dropped otherwise
 		go func() {
 			for {
-				if _, _, rtcpErr := tr.ReadRTP(); rtcpErr != nil {
+				pkt, _, err := tr.ReadRTP()
+				if err != nil {
 					return
 				}
+				st.onPacket(pkt.Timestamp, time.Now())
+
+				f := mgr.getForwarder(tr.Kind())
+				if f == nil {
+					continue
+				}
+				if err := f.forward(pkt); err != nil && !errors.Is(err, net.ErrClosed) {
+					mgr.logger.Warn("Error forwarding %s packet: %s", tr.Kind(), err)
+				}
 			}
 		}()
 	})
@@ -178,16 +289,14 @@ func newWebRTCManager(infoLoggerPort, debugLoggerPort int, iceServers []WebRTCIC
 	return &mgr, nil
 }
 
-func (mgr *WebRTCManager) Info(msg string, args ...any) {
-	mgr.infoLogger.Send(fmt.Sprintf(msg+"\n", args...))
-}
-
-func (mgr *WebRTCManager) Debug(msg string, args ...any) {
-	mgr.debugLogger.Send(fmt.Sprintf(msg+"\n", args...))
+// GetLogger returns the manager's logger, e.g. to set the device ID field,
+// the level or the output format.
+func (mgr *WebRTCManager) GetLogger() *Logger {
+	return mgr.logger
 }
 
 func (mgr *WebRTCManager) PrintTimeSinceCreation() {
-	mgr.Debug("Time elapsed since creation of %s: %s", mgr.name, time.Since(mgr.startTime).String())
+	mgr.logger.Debug("Time elapsed since creation of %s: %s", mgr.name, time.Since(mgr.startTime).String())
 }
 
 /*
@@ -227,28 +336,21 @@ func (mgr *WebRTCManager) DebugDumpKeys(outputDir string) error {
 }
 */
 
-func (mgr *WebRTCManager) initializeRTPListener(kind, codecMimeType string) (conn net.Conn, port int, err error) {
-	// cleanup in case of error
-	defer func() {
-		if err != nil && conn != nil {
-			conn.Close()
-			conn = nil
-		}
-	}()
-
-	conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
-	if err != nil {
-		return conn, 0, err
-	}
-
+// addLocalTrack adds a track for sending media to the remote.
+func (mgr *WebRTCManager) addLocalTrack(codecMimeType string) (*webrtc.TrackLocalStaticRTP, error) {
 	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: codecMimeType}, randString(15), randString(15))
 	if err != nil {
-		return conn, 0, err
+		return nil, err
 	}
 
 	rtpSender, err := mgr.pc.AddTrack(track)
 	if err != nil {
-		return conn, 0, err
+		return nil, err
+	}
+	if encodings := rtpSender.GetParameters().Encodings; len(encodings) > 0 {
+		mgr.statsLock.Lock()
+		mgr.localTracks[track.Kind()] = newStatsTrack(uint32(encodings[0].SSRC), 0)
+		mgr.statsLock.Unlock()
 	}
 
 	// Read incoming RTCP packets
@@ -261,43 +363,81 @@ func (mgr *WebRTCManager) initializeRTPListener(kind, codecMimeType string) (con
 				return
 			}
 			if DEBUG {
-				mgr.Debug(spew.Sdump(pkt))
+				mgr.logger.Debug(spew.Sdump(pkt))
 			}
 		}
 	}()
 
+	return track, nil
+}
+
+// initializeRTPListener forwards RTP packets of up to packetSize bytes
+// received on a local UDP port to a new track. Larger packets would be
+// truncated by the read, so they are dropped instead.
+func (mgr *WebRTCManager) initializeRTPListener(kind, codecMimeType string, packetSize int) (conn net.Conn, port int, err error) {
+	// cleanup in case of error
+	defer func() {
+		if err != nil && conn != nil {
+			conn.Close()
+			conn = nil
+		}
+	}()
+
+	conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 0})
+	if err != nil {
+		return conn, 0, err
+	}
+
+	track, err := mgr.addLocalTrack(codecMimeType)
+	if err != nil {
+		return conn, 0, err
+	}
+
 	go func() {
 		// wait for ice to complete gathering
 		<-mgr.iceCompleteSentinel
 
+		// only audio needs its markers rewritten, video markers
+		// delimit frames and must be passed through untouched
 		mark := true
+		rewriteMarker := kind == "audio"
 
-		inboundRTPPacket := make([]byte, UDP_PACKET_SIZE)
+		oversized := 0
+		inboundRTPPacket := make([]byte, packetSize)
 		for {
 			n, _, err := conn.(*net.UDPConn).ReadFrom(inboundRTPPacket)
 			if err != nil {
 				if !errors.Is(err, net.ErrClosed) {
-					mgr.Info("Error during %s track read: %s", kind, err)
+					mgr.logger.Warn("Error during %s track read: %s", kind, err)
 				}
 				return
 			}
+			if n == len(inboundRTPPacket) {
+				oversized++
+				if oversized%100 == 1 {
+					mgr.logger.Warn("Dropped %d %s RTP packets larger than %d bytes", oversized, kind, packetSize-1)
+				}
+				continue
+			}
 
 			var pkt rtp.Packet
 			if err = pkt.Unmarshal(inboundRTPPacket[:n]); err != nil {
-				mgr.Info("Error unmarshaling RTP packet: %s", err)
+				mgr.logger.Warn("Error unmarshaling RTP packet: %s", err)
 				continue
 			}
 
 			// packets we receive from ffmpeg all have the marker set, which seems to
 			// confuse arlo's backend. therefore, we only set the first packet's marker
-			pkt.Marker = mark
-			if mark {
-				mark = false
+			if rewriteMarker {
+				pkt.Marker = mark
+				if mark {
+					mark = false
+				}
 			}
 
 			if err = track.WriteRTP(&pkt); err != nil {
 				if !errors.Is(err, io.ErrClosedPipe) {
-					mgr.Info("Error writing to %s track: %s", kind, err)
+					mgr.logger.Warn("Error writing to %s track: %s", kind, err)
 				}
 				return
 			}
@@ -309,12 +449,12 @@ func (mgr *WebRTCManager) initializeRTPListener(kind, codecMimeType string) (con
 		return conn, 0, err
 	}
 
-	mgr.Info("Created %s RTP listener at udp://127.0.0.1:%d", kind, port)
+	mgr.logger.Info("Created %s RTP listener at udp://127.0.0.1:%d", kind, port)
 	return conn, port, nil
 }
 
 func (mgr *WebRTCManager) InitializeAudioRTPListener(codecMimeType string) (port int, err error) {
-	conn, port, err := mgr.initializeRTPListener("audio", codecMimeType)
+	conn, port, err := mgr.initializeRTPListener("audio", codecMimeType, UDP_PACKET_SIZE)
 	if err != nil {
 		return 0, err
 	}
@@ -322,6 +462,166 @@ func (mgr *WebRTCManager) InitializeAudioRTPListener(codecMimeType string) (port
 	return port, err
 }
 
+// rtpForwarder rewrites RTP packets received on a remote track and sends
+// them to a local UDP port, the reverse of initializeRTPListener.
+type rtpForwarder struct {
+	conn *net.UDPConn
+	lock *sync.Mutex
+
+	// payload type to write on outgoing packets, or -1 to keep
+	// whatever was negotiated with the remote
+	payloadType int
+	ssrc        uint32
+
+	// if the remote replaces its track, sequence numbers and timestamps
+	// are shifted so consumers see a single continuous stream
+	started   bool
+	srcSSRC   uint32
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+}
+
+func (f *rtpForwarder) forward(pkt *rtp.Packet) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !f.started || pkt.SSRC != f.srcSSRC {
+		if f.started {
+			f.seqOffset = f.lastSeq + 1 - pkt.SequenceNumber
+			f.tsOffset = f.lastTS + 1 - pkt.Timestamp
+		}
+		f.started = true
+		f.srcSSRC = pkt.SSRC
+	}
+
+	pkt.SSRC = f.ssrc
+	pkt.SequenceNumber += f.seqOffset
+	pkt.Timestamp += f.tsOffset
+	if f.payloadType >= 0 {
+		pkt.PayloadType = uint8(f.payloadType)
+	}
+
+	// header extension ids are only meaningful within the negotiated
+	// session, so don't confuse local consumers with them
+	pkt.Extension = false
+	pkt.Extensions = nil
+
+	f.lastSeq = pkt.SequenceNumber
+	f.lastTS = pkt.Timestamp
+
+	buf, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = f.conn.Write(buf)
+	return err
+}
+
+func (mgr *WebRTCManager) getForwarder(kind webrtc.RTPCodecType) *rtpForwarder {
+	mgr.forwardersLock.Lock()
+	defer mgr.forwardersLock.Unlock()
+	return mgr.forwarders[kind]
+}
+
+func (mgr *WebRTCManager) initializeRTPForwarder(kind webrtc.RTPCodecType, port, payloadType int) error {
+	if payloadType > 127 {
+		return fmt.Errorf("invalid payload type %d", payloadType)
+	}
+
+	mgr.forwardersLock.Lock()
+	defer mgr.forwardersLock.Unlock()
+
+	if _, ok := mgr.forwarders[kind]; ok {
+		return fmt.Errorf("%s rtp forwarder already initialized", kind)
+	}
+
+	// make sure we ask the remote to send us this kind of media
+	hasTransceiver := false
+	for _, t := range mgr.pc.GetTransceivers() {
+		if t.Kind() == kind {
+			hasTransceiver = true
+			break
+		}
+	}
+	if !hasTransceiver {
+		_, err := mgr.pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		})
+		if err != nil {
+			return fmt.Errorf("could not add %s transceiver: %w", kind, err)
+		}
+	}
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	if err != nil {
+		return err
+	}
+
+	mgr.forwarders[kind] = &rtpForwarder{
+		conn:        conn,
+		lock:        &sync.Mutex{},
+		payloadType: payloadType,
+		ssrc:        rand.Uint32(),
+	}
+
+	mgr.logger.Info("Created %s RTP forwarder to udp://127.0.0.1:%d", kind, port)
+	return nil
+}
+
+// InitializeAudioRTPForwarder sends audio received from the remote to
+// udp://127.0.0.1:port. If payloadType is negative, the payload type
+// negotiated with the remote is kept.
+func (mgr *WebRTCManager) InitializeAudioRTPForwarder(port, payloadType int) error {
+	return mgr.initializeRTPForwarder(webrtc.RTPCodecTypeAudio, port, payloadType)
+}
+
+func (mgr *WebRTCManager) InitializeVideoRTPListener(codecMimeType string) (port int, err error) {
+	conn, port, err := mgr.initializeRTPListener("video", codecMimeType, videoRTPPacketSize)
+	if err != nil {
+		return 0, err
+	}
+	mgr.videoRTP = conn
+	return port, err
+}
+
+// InitializeVideoRTPForwarder sends video received from the remote to
+// udp://127.0.0.1:port, and requests a keyframe so the consumer can start
+// decoding right away. If payloadType is negative, the payload type
+// negotiated with the remote is kept.
+func (mgr *WebRTCManager) InitializeVideoRTPForwarder(port, payloadType int) error {
+	if err := mgr.initializeRTPForwarder(webrtc.RTPCodecTypeVideo, port, payloadType); err != nil {
+		return err
+	}
+	return mgr.RequestKeyframe()
+}
+
+// RequestKeyframe asks the remote to send a new keyframe on all of its
+// video tracks, using both PLI and FIR since support varies by device.
+// This is a no-op if the remote has not sent any video tracks yet.
+func (mgr *WebRTCManager) RequestKeyframe() error {
+	mgr.forwardersLock.Lock()
+	pkts := []rtcp.Packet{}
+	for _, ssrc := range mgr.remoteVideoSSRCs {
+		mgr.firSequence++
+		pkts = append(pkts,
+			&rtcp.PictureLossIndication{MediaSSRC: ssrc},
+			&rtcp.FullIntraRequest{
+				MediaSSRC: ssrc,
+				FIR:       []rtcp.FIREntry{{SSRC: ssrc, SequenceNumber: mgr.firSequence}},
+			},
+		)
+	}
+	mgr.forwardersLock.Unlock()
+
+	if len(pkts) == 0 {
+		return nil
+	}
+	mgr.logger.Debug("Requesting keyframe from remote")
+	return mgr.pc.WriteRTCP(pkts)
+}
+
 func (mgr *WebRTCManager) CreateOffer() (WebRTCSessionDescription, error) {
 	return mgr.pc.CreateOffer(nil)
 }
@@ -343,26 +643,67 @@ func (mgr *WebRTCManager) AddICECandidate(c WebRTCICECandidateInit) error {
 }
 
 func (mgr *WebRTCManager) WaitForICEComplete() {
-	mgr.Info("Waiting for ICE candidate gathering to finish")
+	mgr.logger.Info("Waiting for ICE candidate gathering to finish")
 	<-mgr.iceCompleteSentinel
-	mgr.Info("ICE candidate gathering complete")
+	mgr.logger.Info("ICE candidate gathering complete")
+}
+
+// candidateLog returns the candidate log of the current ICE generation.
+func (mgr *WebRTCManager) candidateLog() *iceCandidateLog {
+	mgr.iceCandidatesLock.Lock()
+	defer mgr.iceCandidatesLock.Unlock()
+	return mgr.iceCandidates
 }
 
+// newICEGeneration gives the candidates gathered after an ICE restart a
+// log of their own, and ends the previous one for its readers.
+func (mgr *WebRTCManager) newICEGeneration() {
+	mgr.iceCandidatesLock.Lock()
+	previous := mgr.iceCandidates
+	mgr.iceCandidates = newICECandidateLog()
+	mgr.iceCandidatesLock.Unlock()
+	previous.finish()
+}
+
+// GetNextICECandidate blocks until the next local candidate is gathered,
+// returning an error once there are no more. After an ICE restart it
+// starts over with the candidates of the new generation.
 func (mgr *WebRTCManager) GetNextICECandidate() (WebRTCICECandidate, error) {
-	endOfCandidates := fmt.Errorf("no more candidates")
+	mgr.iceCandidatesReadLock.Lock()
+	defer mgr.iceCandidatesReadLock.Unlock()
 
-	select {
-	case c := <-mgr.iceCandidates:
-		return c, nil
-	case <-mgr.iceCompleteSentinel:
-		return WebRTCICECandidate{}, endOfCandidates
+	if log := mgr.candidateLog(); log != mgr.iceCandidatesReadLog {
+		mgr.iceCandidatesReadLog = log
+		mgr.iceCandidatesRead = 0
 	}
+	c, ok := mgr.iceCandidatesReadLog.next(mgr.iceCandidatesRead, nil)
+	if !ok {
+		return WebRTCICECandidate{}, fmt.Errorf("no more candidates")
+	}
+	mgr.iceCandidatesRead++
+	return c, nil
 }
 
 func (mgr *WebRTCManager) Close() {
-	mgr.audioRTP.Close()
+	if mgr.audioRTP != nil {
+		mgr.audioRTP.Close()
+	}
+	if audioPCM := mgr.getAudioPCM(); audioPCM != nil {
+		audioPCM.close()
+	}
+	if mgr.videoRTP != nil {
+		mgr.videoRTP.Close()
+	}
 	mgr.pc.Close()
+	mgr.candidateLog().finish()
+	if mgr.udpMux != nil {
+		mgr.udpMux.Close()
+	}
+	mgr.forwardersLock.Lock()
+	for _, f := range mgr.forwarders {
+		f.conn.Close()
+	}
+	mgr.forwardersLock.Unlock()
 	mgr.PrintTimeSinceCreation()
-	mgr.infoLogger.Close()
-	mgr.debugLogger.Close()
+	mgr.logger.Close()
 }
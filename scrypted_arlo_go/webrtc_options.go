@@ -0,0 +1,142 @@
+package scrypted_arlo_go
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v3"
+)
+
+// modes for WebRTCOptions.MulticastDNSMode
+const (
+	WebRTCMulticastDNSModeDisabled = "disabled"
+	WebRTCMulticastDNSModeQuery    = "query"
+	WebRTCMulticastDNSModeGather   = "gather"
+)
+
+// pion's ICE timeouts, used for whichever of the timeouts in
+// WebRTCOptions are left unset
+const (
+	defaultICEDisconnectedTimeout = 5 * time.Second
+	defaultICEFailedTimeout       = 25 * time.Second
+	defaultICEKeepAliveInterval   = 2 * time.Second
+)
+
+// WebRTCOptions configures the peer connection of a WebRTC manager. Zero
+// values keep pion's defaults.
+type WebRTCOptions struct {
+	// range of local UDP ports to gather candidates on, e.g. to match
+	// firewall rules
+	PortMin int
+	PortMax int
+
+	// public IPs to advertise when running behind a 1:1 NAT, either as
+	// "host" candidates in place of the local addresses or as additional
+	// "srflx" candidates
+	NAT1To1IPs           []string
+	NAT1To1CandidateType string
+
+	// which interfaces and IPs are gathered on and which candidates are
+	// signalled. nil allows everything, except for SIPWebRTCManager which
+	// uses DefaultICECandidatePolicy
+	CandidatePolicy *ICECandidatePolicy
+
+	// one of the WebRTCMulticastDNSMode constants. gathered mDNS
+	// candidates are not signalled if CandidatePolicy.DenyMDNS is set
+	MulticastDNSMode string
+
+	// gather all UDP candidates on this single port instead of one
+	// ephemeral port each, overrides PortMin and PortMax
+	UDPMuxPort int
+
+	// share a process-wide mux with other managers instead, can't be
+	// combined with UDPMuxPort
+	ICEMux *ICEMux
+
+	ICEDisconnectedTimeout Duration
+	ICEFailedTimeout       Duration
+	ICEKeepAliveInterval   Duration
+}
+
+// NewWebRTCOptions returns options that keep pion's defaults.
+func NewWebRTCOptions() *WebRTCOptions {
+	return &WebRTCOptions{}
+}
+
+// applyTo configures s with the options. If a UDP mux is opened, it is
+// returned so that it can be closed along with the peer connection.
+func (o *WebRTCOptions) applyTo(s *webrtc.SettingEngine, policy *ICECandidatePolicy, loggerFactory logging.LoggerFactory) (*ice.MultiUDPMuxDefault, error) {
+	policy.applyTo(s)
+
+	if o.PortMin != 0 || o.PortMax != 0 {
+		if o.PortMin <= 0 || o.PortMax > 65535 {
+			return nil, fmt.Errorf("invalid UDP port range %d-%d", o.PortMin, o.PortMax)
+		}
+		if err := s.SetEphemeralUDPPortRange(uint16(o.PortMin), uint16(o.PortMax)); err != nil {
+			return nil, fmt.Errorf("invalid UDP port range %d-%d: %w", o.PortMin, o.PortMax, err)
+		}
+	}
+
+	if len(o.NAT1To1IPs) > 0 {
+		candidateType := webrtc.ICECandidateTypeHost
+		if o.NAT1To1CandidateType != "" {
+			var err error
+			if candidateType, err = webrtc.NewICECandidateType(o.NAT1To1CandidateType); err != nil {
+				return nil, fmt.Errorf("invalid NAT 1:1 candidate type %q", o.NAT1To1CandidateType)
+			}
+		}
+		if candidateType != webrtc.ICECandidateTypeHost && candidateType != webrtc.ICECandidateTypeSrflx {
+			return nil, fmt.Errorf("NAT 1:1 candidate type must be host or srflx, not %q", o.NAT1To1CandidateType)
+		}
+		s.SetNAT1To1IPs(o.NAT1To1IPs, candidateType)
+	}
+
+	switch o.MulticastDNSMode {
+	case "":
+	case WebRTCMulticastDNSModeDisabled:
+		s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	case WebRTCMulticastDNSModeQuery:
+		s.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryOnly)
+	case WebRTCMulticastDNSModeGather:
+		s.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryAndGather)
+	default:
+		return nil, fmt.Errorf("unknown mDNS mode %q", o.MulticastDNSMode)
+	}
+
+	if o.ICEDisconnectedTimeout != 0 || o.ICEFailedTimeout != 0 || o.ICEKeepAliveInterval != 0 {
+		orDefault := func(d, def Duration) Duration {
+			if d == 0 {
+				return def
+			}
+			return d
+		}
+		s.SetICETimeouts(
+			orDefault(o.ICEDisconnectedTimeout, defaultICEDisconnectedTimeout),
+			orDefault(o.ICEFailedTimeout, defaultICEFailedTimeout),
+			orDefault(o.ICEKeepAliveInterval, defaultICEKeepAliveInterval),
+		)
+	}
+
+	if o.ICEMux != nil {
+		if o.UDPMuxPort != 0 {
+			return nil, fmt.Errorf("UDPMuxPort can't be used with a shared ICEMux")
+		}
+		o.ICEMux.applyTo(s)
+		return nil, nil
+	}
+	if o.UDPMuxPort == 0 {
+		return nil, nil
+	}
+	udpMux, err := ice.NewMultiUDPMuxFromPort(o.UDPMuxPort,
+		ice.UDPMuxFromPortWithInterfaceFilter(policy.allowsInterface),
+		ice.UDPMuxFromPortWithIPFilter(policy.allowsLocalIP),
+		ice.UDPMuxFromPortWithLogger(loggerFactory.NewLogger("udpmux")),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on UDP mux port %d: %w", o.UDPMuxPort, err)
+	}
+	s.SetICEUDPMux(udpMux)
+	return udpMux, nil
+}
@@ -0,0 +1,203 @@
+package scrypted_arlo_go
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// states reported by WebRTCManager.GetState
+const (
+	WebRTCStateNew          = "new"
+	WebRTCStateConnecting   = "connecting"
+	WebRTCStateConnected    = "connected"
+	WebRTCStateDisconnected = "disconnected"
+	WebRTCStateRestarting   = "restarting"
+	WebRTCStateFailed       = "failed"
+	WebRTCStateClosed       = "closed"
+)
+
+const (
+	// how long to wait for candidates for an ICE restart offer
+	iceRestartGatherTimeout = 5 * time.Second
+
+	// delay before trying again when an ICE restart couldn't be sent
+	iceRestartRetryInterval = 2 * time.Second
+)
+
+// EnableRecovery keeps the session alive for up to gracePeriod after the
+// connection is lost, instead of closing it immediately. During that time
+// an ICE restart is attempted through the callback set with
+// SetICERestartCallback, or by re-INVITE for SIPWebRTCManager. Without
+// either, ICE is only given the chance to recover on its own. A grace
+// period of 0 disables recovery.
+func (mgr *WebRTCManager) EnableRecovery(gracePeriod Duration) {
+	mgr.recoveryLock.Lock()
+	defer mgr.recoveryLock.Unlock()
+	mgr.recoveryGrace = gracePeriod
+}
+
+// SetICERestartCallback registers cb to deliver an ICE restart offer to
+// the remote. The remote's answer must be passed to SetRemoteDescription.
+func (mgr *WebRTCManager) SetICERestartCallback(cb func(offerSDP string)) {
+	mgr.recoveryLock.Lock()
+	defer mgr.recoveryLock.Unlock()
+	mgr.restartICE = func(offerSDP string, deadline time.Time) error {
+		cb(offerSDP)
+		return nil
+	}
+}
+
+// SetStateCallback registers cb to be called with the new state whenever
+// it changes.
+func (mgr *WebRTCManager) SetStateCallback(cb func(state string)) {
+	mgr.recoveryLock.Lock()
+	defer mgr.recoveryLock.Unlock()
+	mgr.stateCallback = cb
+}
+
+// GetState returns the current state of the session.
+func (mgr *WebRTCManager) GetState() string {
+	mgr.recoveryLock.Lock()
+	defer mgr.recoveryLock.Unlock()
+	return mgr.state
+}
+
+func (mgr *WebRTCManager) setState(state string) {
+	mgr.recoveryLock.Lock()
+	if mgr.state == state {
+		mgr.recoveryLock.Unlock()
+		return
+	}
+	mgr.state = state
+	cb := mgr.stateCallback
+	mgr.recoveryLock.Unlock()
+
+	mgr.logger.Debug("Session is %s", state)
+	if cb != nil {
+		cb(state)
+	}
+}
+
+func (mgr *WebRTCManager) onConnectionStateChange(s webrtc.PeerConnectionState) {
+	mgr.logger.Debug("OnConnectionStateChange %s", s.String())
+
+	mgr.recoveryLock.Lock()
+	grace := mgr.recoveryGrace
+	recovered := mgr.recovered
+	mgr.recoveryLock.Unlock()
+
+	switch s {
+	case webrtc.PeerConnectionStateConnected:
+		mgr.PrintTimeSinceCreation()
+		if recovered != nil {
+			mgr.recoveryLock.Lock()
+			mgr.recovered = nil
+			mgr.recoveryLock.Unlock()
+			close(recovered)
+			mgr.logger.Info("Connection recovered")
+		}
+		mgr.setState(WebRTCStateConnected)
+
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+		if recovered != nil {
+			// already recovering
+			return
+		}
+		if grace <= 0 {
+			mgr.setState(s.String())
+			if s == webrtc.PeerConnectionStateDisconnected {
+				mgr.closeFunc()
+			}
+			return
+		}
+
+		recovered = make(chan struct{})
+		mgr.recoveryLock.Lock()
+		mgr.recovered = recovered
+		mgr.recoveryLock.Unlock()
+
+		mgr.logger.Info("Connection lost, attempting recovery for up to %s", grace)
+		mgr.setState(WebRTCStateDisconnected)
+		go mgr.recover(recovered, grace)
+
+	case webrtc.PeerConnectionStateClosed:
+		mgr.setState(WebRTCStateClosed)
+
+	default:
+		// restarting ICE passes through connecting, which is reported as
+		// part of the recovery instead
+		if recovered == nil {
+			mgr.setState(s.String())
+		}
+	}
+}
+
+// recover restarts ICE until the connection comes back or the grace
+// period runs out, at which point the session is closed.
+func (mgr *WebRTCManager) recover(recovered chan struct{}, grace time.Duration) {
+	end := time.Now().Add(grace)
+	deadline := time.NewTimer(grace)
+	defer deadline.Stop()
+
+	for {
+		mgr.setState(WebRTCStateRestarting)
+
+		var retry <-chan time.Time
+		if err := mgr.restart(end); err != nil {
+			mgr.logger.Warn("Could not restart ICE: %s", err)
+			retry = time.After(iceRestartRetryInterval)
+		}
+
+		select {
+		case <-recovered:
+			return
+		case <-retry:
+			continue
+		case <-deadline.C:
+		}
+
+		if mgr.pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		mgr.logger.Warn("Connection did not recover within %s", grace)
+		mgr.setState(WebRTCStateFailed)
+		mgr.closeFunc()
+		return
+	}
+}
+
+// restart creates an offer with new ICE credentials and hands it to the
+// remote, giving up at deadline. Without a way to signal the offer,
+// nothing is done and ICE is left to recover on its own.
+func (mgr *WebRTCManager) restart(deadline time.Time) error {
+	mgr.recoveryLock.Lock()
+	restartICE := mgr.restartICE
+	mgr.recoveryLock.Unlock()
+	if restartICE == nil {
+		return nil
+	}
+
+	offer, err := mgr.pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return fmt.Errorf("could not create offer: %w", err)
+	}
+	mgr.newICEGeneration()
+	gathered := webrtc.GatheringCompletePromise(mgr.pc)
+	if err := mgr.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("could not set local description: %w", err)
+	}
+
+	gatherTimeout := iceRestartGatherTimeout
+	if untilDeadline := time.Until(deadline); untilDeadline < gatherTimeout {
+		gatherTimeout = untilDeadline
+	}
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+		mgr.logger.Debug("ICE gathering for restart timed out, sending the candidates found so far")
+	}
+
+	return restartICE(mgr.pc.LocalDescription().SDP, deadline)
+}
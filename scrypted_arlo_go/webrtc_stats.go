@@ -0,0 +1,237 @@
+package scrypted_arlo_go
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/webrtc/v3"
+)
+
+// WebRTCStats is a snapshot of a peer connection's statistics, flattened
+// so that it can be read from Python. Times are in seconds. Fields for a
+// direction or media kind that the session doesn't have are left at zero.
+type WebRTCStats struct {
+	ConnectionState    string
+	ICEConnectionState string
+
+	// the ICE candidate pair in use
+	LocalCandidateType      string
+	LocalCandidateAddress   string
+	LocalCandidatePort      int
+	LocalCandidateProtocol  string
+	RemoteCandidateType     string
+	RemoteCandidateAddress  string
+	RemoteCandidatePort     int
+	RemoteCandidateProtocol string
+	RoundTripTime           float64
+
+	// audio we send, e.g. push to talk, as reported back by the remote
+	AudioPacketsSent        uint64
+	AudioBytesSent          uint64
+	AudioNACKsReceived      int
+	AudioRemotePacketsLost  int64
+	AudioRemoteFractionLost float64
+	AudioRemoteJitter       float64
+	AudioRemoteRoundTrip    float64
+
+	// audio we receive
+	AudioPacketsReceived uint64
+	AudioBytesReceived   uint64
+	AudioPacketsLost     int64
+	AudioJitter          float64
+	AudioNACKsSent       int
+
+	// video we send, as reported back by the remote
+	VideoPacketsSent        uint64
+	VideoBytesSent          uint64
+	VideoNACKsReceived      int
+	VideoPLIsReceived       int
+	VideoFIRsReceived       int
+	VideoRemotePacketsLost  int64
+	VideoRemoteFractionLost float64
+	VideoRemoteJitter       float64
+	VideoRemoteRoundTrip    float64
+
+	// video we receive
+	VideoPacketsReceived uint64
+	VideoBytesReceived   uint64
+	VideoPacketsLost     int64
+	VideoJitter          float64
+	VideoNACKsSent       int
+	VideoPLIsSent        int
+	VideoFIRsSent        int
+}
+
+// statsTrack identifies an RTP stream whose statistics are collected by
+// the stats interceptor.
+type statsTrack struct {
+	ssrc      uint32
+	clockRate uint32
+
+	// RFC 3550 interarrival jitter of a received stream, in timestamp
+	// units. the stats interceptor measures arrival relative to the
+	// previous packet rather than absolutely, which makes its estimate
+	// converge on the packet interval, so it is tracked here instead
+	lock          *sync.Mutex
+	jitter        float64
+	lastArrival   time.Time
+	lastTimestamp uint32
+}
+
+func newStatsTrack(ssrc, clockRate uint32) *statsTrack {
+	return &statsTrack{ssrc: ssrc, clockRate: clockRate, lock: &sync.Mutex{}}
+}
+
+// onPacket updates the jitter estimate with a received packet.
+func (t *statsTrack) onPacket(timestamp uint32, arrival time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.lastArrival.IsZero() {
+		elapsed := arrival.Sub(t.lastArrival).Seconds() * float64(t.clockRate)
+		d := math.Abs(elapsed - float64(int32(timestamp-t.lastTimestamp)))
+		t.jitter += (d - t.jitter) / 16
+	}
+	t.lastArrival = arrival
+	t.lastTimestamp = timestamp
+}
+
+// jitterSeconds returns the jitter estimate in seconds.
+func (t *statsTrack) jitterSeconds() float64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.clockRate == 0 {
+		return 0
+	}
+	return t.jitter / float64(t.clockRate)
+}
+
+// GetStats returns the current statistics of the peer connection.
+func (mgr *WebRTCManager) GetStats() *WebRTCStats {
+	s := &WebRTCStats{
+		ConnectionState:    mgr.pc.ConnectionState().String(),
+		ICEConnectionState: mgr.pc.ICEConnectionState().String(),
+	}
+	mgr.collectCandidatePairStats(s)
+
+	mgr.statsLock.Lock()
+	getter := mgr.statsGetter
+	localAudio, hasLocalAudio := mgr.localTracks[webrtc.RTPCodecTypeAudio]
+	localVideo, hasLocalVideo := mgr.localTracks[webrtc.RTPCodecTypeVideo]
+	remoteAudio, hasRemoteAudio := mgr.remoteTracks[webrtc.RTPCodecTypeAudio]
+	remoteVideo, hasRemoteVideo := mgr.remoteTracks[webrtc.RTPCodecTypeVideo]
+	mgr.statsLock.Unlock()
+
+	if getter == nil {
+		return s
+	}
+
+	if hasLocalAudio {
+		if st := getter.Get(localAudio.ssrc); st != nil {
+			s.AudioPacketsSent = st.OutboundRTPStreamStats.PacketsSent
+			s.AudioBytesSent = st.OutboundRTPStreamStats.BytesSent
+			s.AudioNACKsReceived = int(st.OutboundRTPStreamStats.NACKCount)
+			s.AudioRemotePacketsLost = st.RemoteInboundRTPStreamStats.PacketsLost
+			s.AudioRemoteFractionLost = st.RemoteInboundRTPStreamStats.FractionLost
+			s.AudioRemoteJitter = st.RemoteInboundRTPStreamStats.Jitter
+			s.AudioRemoteRoundTrip = st.RemoteInboundRTPStreamStats.RoundTripTime.Seconds()
+		}
+	}
+
+	if hasLocalVideo {
+		if st := getter.Get(localVideo.ssrc); st != nil {
+			s.VideoPacketsSent = st.OutboundRTPStreamStats.PacketsSent
+			s.VideoBytesSent = st.OutboundRTPStreamStats.BytesSent
+			s.VideoNACKsReceived = int(st.OutboundRTPStreamStats.NACKCount)
+			s.VideoPLIsReceived = int(st.OutboundRTPStreamStats.PLICount)
+			s.VideoFIRsReceived = int(st.OutboundRTPStreamStats.FIRCount)
+			s.VideoRemotePacketsLost = st.RemoteInboundRTPStreamStats.PacketsLost
+			s.VideoRemoteFractionLost = st.RemoteInboundRTPStreamStats.FractionLost
+			s.VideoRemoteJitter = st.RemoteInboundRTPStreamStats.Jitter
+			s.VideoRemoteRoundTrip = st.RemoteInboundRTPStreamStats.RoundTripTime.Seconds()
+		}
+	}
+
+	if hasRemoteAudio {
+		if st := getter.Get(remoteAudio.ssrc); st != nil {
+			s.AudioPacketsReceived = st.InboundRTPStreamStats.PacketsReceived
+			s.AudioBytesReceived = st.InboundRTPStreamStats.BytesReceived
+			s.AudioPacketsLost = st.InboundRTPStreamStats.PacketsLost
+			s.AudioJitter = remoteAudio.jitterSeconds()
+			s.AudioNACKsSent = int(st.InboundRTPStreamStats.NACKCount)
+		}
+	}
+
+	if hasRemoteVideo {
+		if st := getter.Get(remoteVideo.ssrc); st != nil {
+			s.VideoPacketsReceived = st.InboundRTPStreamStats.PacketsReceived
+			s.VideoBytesReceived = st.InboundRTPStreamStats.BytesReceived
+			s.VideoPacketsLost = st.InboundRTPStreamStats.PacketsLost
+			s.VideoJitter = remoteVideo.jitterSeconds()
+			s.VideoNACKsSent = int(st.InboundRTPStreamStats.NACKCount)
+			s.VideoPLIsSent = int(st.InboundRTPStreamStats.PLICount)
+			s.VideoFIRsSent = int(st.InboundRTPStreamStats.FIRCount)
+		}
+	}
+
+	return s
+}
+
+// collectCandidatePairStats fills in the nominated ICE candidate pair from
+// pion's own stats report.
+func (mgr *WebRTCManager) collectCandidatePairStats(s *WebRTCStats) {
+	report := mgr.pc.GetStats()
+
+	var pair *webrtc.ICECandidatePairStats
+	for _, stat := range report {
+		p, ok := stat.(webrtc.ICECandidatePairStats)
+		if !ok || !p.Nominated {
+			continue
+		}
+		if pair == nil || p.State == webrtc.StatsICECandidatePairStateSucceeded {
+			pair = &p
+		}
+	}
+	if pair == nil {
+		return
+	}
+
+	s.RoundTripTime = pair.CurrentRoundTripTime
+
+	if local, ok := report[pair.LocalCandidateID].(webrtc.ICECandidateStats); ok {
+		s.LocalCandidateType = local.CandidateType.String()
+		s.LocalCandidateAddress = local.IP
+		s.LocalCandidatePort = int(local.Port)
+		s.LocalCandidateProtocol = local.Protocol
+	}
+	if remote, ok := report[pair.RemoteCandidateID].(webrtc.ICECandidateStats); ok {
+		s.RemoteCandidateType = remote.CandidateType.String()
+		s.RemoteCandidateAddress = remote.IP
+		s.RemoteCandidatePort = int(remote.Port)
+		s.RemoteCandidateProtocol = remote.Protocol
+	}
+}
+
+// GetStats returns the current statistics of the call.
+func (sm *SIPWebRTCManager) GetStats() *WebRTCStats {
+	return sm.webrtc.GetStats()
+}
+
+// registerStatsInterceptor collects per-stream RTP statistics, which pion's
+// own stats report leaves out.
+func (mgr *WebRTCManager) registerStatsInterceptor(i *interceptor.Registry) error {
+	factory, err := stats.NewInterceptor()
+	if err != nil {
+		return err
+	}
+	factory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+		mgr.statsLock.Lock()
+		defer mgr.statsLock.Unlock()
+		mgr.statsGetter = getter
+	})
+	i.Add(factory)
+	return nil
+}
@@ -1,21 +1,96 @@
 package scrypted_arlo_go
 
 import (
+	"bytes"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
 )
 
-func VerifyCertHostname(cert, hostname string) error {
+func parseCertPEM(cert string) (*x509.Certificate, error) {
 	p, _ := pem.Decode([]byte(cert))
 	if p == nil {
-		return fmt.Errorf("could not decode cert PEM")
+		return nil, fmt.Errorf("could not decode cert PEM")
 	}
 
 	c, err := x509.ParseCertificate(p.Bytes)
 	if err != nil {
-		return fmt.Errorf("could not parse cert: %w", err)
+		return nil, fmt.Errorf("could not parse cert: %w", err)
+	}
+	return c, nil
+}
+
+func VerifyCertHostname(cert, hostname string) error {
+	c, err := parseCertPEM(cert)
+	if err != nil {
+		return err
 	}
 
 	return c.VerifyHostname(hostname)
 }
+
+// peerCertificateVerifier is the signature of tls.Config.VerifyPeerCertificate.
+type peerCertificateVerifier func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+// newPeerCertificateVerifier checks the peer's certificate against a
+// pinned certificate, a CA and hostname, or both. At least one of
+// pinnedPEM and caPEM must be set.
+func newPeerCertificateVerifier(hostname, pinnedPEM, caPEM string) (peerCertificateVerifier, error) {
+	var pinned *x509.Certificate
+	if pinnedPEM != "" {
+		c, err := parseCertPEM(pinnedPEM)
+		if err != nil {
+			return nil, fmt.Errorf("could not load pinned certificate: %w", err)
+		}
+		pinned = c
+	}
+
+	var roots *x509.CertPool
+	if caPEM != "" {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM([]byte(caPEM)) {
+			return nil, fmt.Errorf("could not load CA certificates: no certificates found in PEM")
+		}
+	}
+
+	if pinned == nil && roots == nil {
+		return nil, fmt.Errorf("no pinned certificate or CA to verify against")
+	}
+
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("peer presented no certificate")
+		}
+
+		if pinned != nil && !bytes.Equal(rawCerts[0], pinned.Raw) {
+			return fmt.Errorf("peer certificate does not match the pinned certificate")
+		}
+
+		if roots != nil {
+			certs := make([]*x509.Certificate, len(rawCerts))
+			for i, raw := range rawCerts {
+				c, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return fmt.Errorf("could not parse peer certificate: %w", err)
+				}
+				certs[i] = c
+			}
+
+			intermediates := x509.NewCertPool()
+			for _, c := range certs[1:] {
+				intermediates.AddCert(c)
+			}
+
+			_, err := certs[0].Verify(x509.VerifyOptions{
+				DNSName:       hostname,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			if err != nil {
+				return fmt.Errorf("peer certificate failed verification against CA for %s: %w", hostname, err)
+			}
+		}
+
+		return nil
+	}, nil
+}